@@ -0,0 +1,196 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/idtoken"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// the headers with the identity of the user authenticated by IAP, and the signed JWT asserting it
+const (
+	userEmailHeader = "X-Goog-Authenticated-User-Email"
+	userIDHeader    = "X-Goog-Authenticated-User-Id"
+	assertionHeader = "X-Goog-IAP-JWT-Assertion"
+)
+
+// Options of the audit log
+type Options struct {
+	// File to write the audit log to, - for stdout or empty to disable the audit log
+	File string
+	// MaxSize in megabytes of the file before it is rotated
+	MaxSize int
+	// MaxBackups is the number of rotated files to keep
+	MaxBackups int
+	// MaxAge in days of the rotated files to keep, 0 to keep them regardless of age
+	MaxAge int
+	// IAPAudience is the audience of the JWT assertion of IAP, /projects/<number>/global/backendServices/<id>.
+	// Without it, the identity of the user is recorded as unverified.
+	IAPAudience string
+}
+
+// User is the identity of the user authenticated by IAP. The identity is verified when it is taken from the
+// signed JWT assertion of IAP, otherwise it is copied from the headers which anyone bypassing IAP can set.
+type User struct {
+	Email    string `json:"email,omitempty"`
+	ID       string `json:"id,omitempty"`
+	Verified bool   `json:"verified"`
+}
+
+// Entry of the audit log. The field names are part of the schema of the audit log, and must not change.
+type Entry struct {
+	Time       time.Time          `json:"time"`
+	RequestID  string             `json:"requestId"`
+	User       User               `json:"user"`
+	SourceIP   string             `json:"sourceIp"`
+	Host       string             `json:"host"`
+	Cluster    string             `json:"cluster"`
+	Method     string             `json:"method"`
+	Path       string             `json:"path"`
+	Query      string             `json:"query,omitempty"`
+	Status     int                `json:"status"`
+	Latency    float64            `json:"latencySeconds"`
+	Kubernetes *KubernetesRequest `json:"kubernetes"`
+}
+
+// Logger writes the audit log entries as JSON lines
+type Logger struct {
+	mutex    sync.Mutex
+	encoder  *json.Encoder
+	closer   io.Closer
+	audience string
+	validate func(ctx context.Context, token, audience string) (*idtoken.Payload, error)
+}
+
+// New returns the logger writing to the file in the options, which is rotated when it reaches the maximum
+// size. Returns nil if the audit log is disabled.
+func New(options Options) (*Logger, error) {
+	switch options.File {
+	case "":
+		return nil, nil
+	case "-":
+		logger := NewLogger(os.Stdout)
+		logger.audience = options.IAPAudience
+		return logger, nil
+	}
+
+	if options.MaxSize <= 0 {
+		return nil, fmt.Errorf("the maximum size of the audit log must be positive")
+	}
+	file := &lumberjack.Logger{
+		Filename:   options.File,
+		MaxSize:    options.MaxSize,
+		MaxBackups: options.MaxBackups,
+		MaxAge:     options.MaxAge,
+	}
+	logger := NewLogger(file)
+	logger.closer = file
+	logger.audience = options.IAPAudience
+	return logger, nil
+}
+
+// NewLogger returns the logger writing to w, which records the identity of the users as unverified
+func NewLogger(w io.Writer) *Logger {
+	return &Logger{encoder: json.NewEncoder(w), validate: idtoken.Validate}
+}
+
+// Log writes the entry for the request to the cluster. Does nothing on a nil logger.
+func (l *Logger) Log(r *http.Request, requestID, cluster string, status int, start time.Time) error {
+	if l == nil {
+		return nil
+	}
+	entry := NewEntry(r, l.userOf(r, requestID), requestID, cluster, status, start)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.encoder.Encode(entry)
+}
+
+// Close closes the audit log file
+func (l *Logger) Close() error {
+	if l == nil || l.closer == nil {
+		return nil
+	}
+	return l.closer.Close()
+}
+
+// NewEntry returns the audit log entry for the request of the user to the cluster
+func NewEntry(r *http.Request, user User, requestID, cluster string, status int, start time.Time) *Entry {
+	return &Entry{
+		Time:       start.UTC(),
+		RequestID:  requestID,
+		User:       user,
+		SourceIP:   SourceIP(r),
+		Host:       r.Host,
+		Cluster:    cluster,
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Query:      r.URL.RawQuery,
+		Status:     status,
+		Latency:    time.Since(start).Seconds(),
+		Kubernetes: ParseKubernetesRequest(r.Method, r.URL),
+	}
+}
+
+// userOf returns the identity of the user from the JWT assertion of IAP, without the accounts.google.com: prefix.
+// When the assertion is missing or invalid, the unverified identity in the headers added by IAP is returned.
+func (l *Logger) userOf(r *http.Request, requestID string) User {
+	if assertion := r.Header.Get(assertionHeader); l.audience != "" && assertion != "" {
+		payload, err := l.validate(r.Context(), assertion, l.audience)
+		if err == nil {
+			email, _ := payload.Claims["email"].(string)
+			return User{
+				Email:    strings.TrimPrefix(email, "accounts.google.com:"),
+				ID:       strings.TrimPrefix(payload.Subject, "accounts.google.com:"),
+				Verified: true,
+			}
+		}
+		slog.Warn("invalid IAP JWT assertion, recording the identity of the user as unverified", "requestId", requestID, "error", err)
+	}
+
+	return User{
+		Email: strings.TrimPrefix(r.Header.Get(userEmailHeader), "accounts.google.com:"),
+		ID:    strings.TrimPrefix(r.Header.Get(userIDHeader), "accounts.google.com:"),
+	}
+}
+
+// SourceIP returns the address of the client from the X-Forwarded-For header. The Google load balancer appends
+// the client address and its own address, so the second to last entry is the one added by the load balancer.
+// Without the header, the remote address of the connection is returned.
+func SourceIP(r *http.Request) string {
+	var addresses []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		for _, address := range strings.Split(value, ",") {
+			if address = strings.TrimSpace(address); address != "" {
+				addresses = append(addresses, address)
+			}
+		}
+	}
+
+	switch len(addresses) {
+	case 0:
+		return remoteHost(r.RemoteAddr)
+	case 1:
+		return addresses[0]
+	default:
+		return addresses[len(addresses)-2]
+	}
+}
+
+func remoteHost(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	return host
+}
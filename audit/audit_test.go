@@ -0,0 +1,117 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"google.golang.org/api/idtoken"
+)
+
+func TestParseKubernetesRequest(t *testing.T) {
+	tests := []struct {
+		method string
+		url    string
+		want   KubernetesRequest
+	}{
+		{http.MethodGet, "/api/v1/namespaces/default/pods",
+			KubernetesRequest{Verb: "list", APIVersion: "v1", Resource: "pods", Namespace: "default"}},
+		{http.MethodGet, "/api/v1/namespaces/default/pods/web-0/log",
+			KubernetesRequest{Verb: "get", APIVersion: "v1", Resource: "pods", Namespace: "default", Name: "web-0", Subresource: "log"}},
+		{http.MethodGet, "/api/v1/namespaces/default/pods?watch=true",
+			KubernetesRequest{Verb: "watch", APIVersion: "v1", Resource: "pods", Namespace: "default"}},
+		{http.MethodGet, "/api/v1/watch/namespaces/default/pods",
+			KubernetesRequest{Verb: "watch", APIVersion: "v1", Resource: "pods", Namespace: "default"}},
+		{http.MethodPatch, "/apis/apps/v1/namespaces/prod/deployments/api",
+			KubernetesRequest{Verb: "patch", APIGroup: "apps", APIVersion: "v1", Resource: "deployments", Namespace: "prod", Name: "api"}},
+		{http.MethodDelete, "/apis/apps/v1/namespaces/prod/deployments",
+			KubernetesRequest{Verb: "deletecollection", APIGroup: "apps", APIVersion: "v1", Resource: "deployments", Namespace: "prod"}},
+		{http.MethodPost, "/api/v1/namespaces",
+			KubernetesRequest{Verb: "create", APIVersion: "v1", Resource: "namespaces"}},
+		{http.MethodDelete, "/api/v1/namespaces/test",
+			KubernetesRequest{Verb: "delete", APIVersion: "v1", Resource: "namespaces", Namespace: "test", Name: "test"}},
+		{http.MethodGet, "/apis/rbac.authorization.k8s.io/v1/clusterroles/admin",
+			KubernetesRequest{Verb: "get", APIGroup: "rbac.authorization.k8s.io", APIVersion: "v1", Resource: "clusterroles", Name: "admin"}},
+		{http.MethodGet, "/version",
+			KubernetesRequest{Verb: "get", NonResource: true}},
+		{http.MethodGet, "/apis/apps/v1",
+			KubernetesRequest{Verb: "get", APIGroup: "apps", APIVersion: "v1", NonResource: true}},
+	}
+
+	for _, test := range tests {
+		u, err := url.Parse(test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ParseKubernetesRequest(test.method, u); *got != test.want {
+			t.Errorf("%s %s: expected %+v, got %+v", test.method, test.url, test.want, *got)
+		}
+	}
+}
+
+func TestLog(t *testing.T) {
+	var output bytes.Buffer
+	logger := NewLogger(&output)
+
+	r := httptest.NewRequest(http.MethodGet, "https://10.0.0.2/api/v1/namespaces/default/secrets/token", nil)
+	r.Header.Set("X-Goog-Authenticated-User-Email", "accounts.google.com:jane@example.com")
+	r.Header.Set("X-Forwarded-For", "203.0.113.7, 35.191.0.1")
+	if err := logger.Log(r, "abc", "cluster-1", http.StatusForbidden, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	var entry Entry
+	if err := json.Unmarshal(output.Bytes(), &entry); err != nil {
+		t.Fatalf("expected a single JSON audit log entry, got %s", output.String())
+	}
+	if entry.User.Email != "jane@example.com" || entry.SourceIP != "203.0.113.7" || entry.Cluster != "cluster-1" ||
+		entry.Status != http.StatusForbidden || entry.RequestID != "abc" {
+		t.Errorf("expected the identity, source ip, cluster and status, got %s", output.String())
+	}
+	if entry.Kubernetes == nil || entry.Kubernetes.Verb != "get" || entry.Kubernetes.Resource != "secrets" {
+		t.Errorf("expected the kubernetes request, got %s", output.String())
+	}
+
+	var disabled *Logger
+	if err := disabled.Log(r, "abc", "cluster-1", http.StatusOK, time.Now()); err != nil {
+		t.Errorf("expected a nil logger to ignore the entry, got %s", err)
+	}
+}
+
+func TestVerifiedUser(t *testing.T) {
+	var output bytes.Buffer
+	logger := NewLogger(&output)
+	logger.audience = "/projects/1234/global/backendServices/5678"
+	logger.validate = func(_ context.Context, token, audience string) (*idtoken.Payload, error) {
+		if token != "signed-assertion" || audience != logger.audience {
+			return nil, fmt.Errorf("invalid signature")
+		}
+		return &idtoken.Payload{Subject: "accounts.google.com:1234", Claims: map[string]interface{}{"email": "jane@example.com"}}, nil
+	}
+
+	tests := []struct {
+		assertion string
+		want      User
+	}{
+		{"signed-assertion", User{Email: "jane@example.com", ID: "1234", Verified: true}},
+		{"forged-assertion", User{Email: "admin@example.com", ID: "42"}},
+		{"", User{Email: "admin@example.com", ID: "42"}},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "https://10.0.0.2/api/v1/pods", nil)
+		r.Header.Set("X-Goog-Authenticated-User-Email", "accounts.google.com:admin@example.com")
+		r.Header.Set("X-Goog-Authenticated-User-Id", "accounts.google.com:42")
+		if test.assertion != "" {
+			r.Header.Set("X-Goog-IAP-JWT-Assertion", test.assertion)
+		}
+		if got := logger.userOf(r, "abc"); got != test.want {
+			t.Errorf("assertion %q: expected %+v, got %+v", test.assertion, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package audit
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// KubernetesRequest describes the Kubernetes API operation of a request, like the request info of the API server
+type KubernetesRequest struct {
+	Verb        string `json:"verb"`
+	APIGroup    string `json:"apiGroup,omitempty"`
+	APIVersion  string `json:"apiVersion,omitempty"`
+	Resource    string `json:"resource,omitempty"`
+	Subresource string `json:"subresource,omitempty"`
+	Namespace   string `json:"namespace,omitempty"`
+	Name        string `json:"name,omitempty"`
+	NonResource bool   `json:"nonResource,omitempty"`
+}
+
+// ParseKubernetesRequest parses the method and path of a request into the Kubernetes API operation. Paths
+// outside /api and /apis are non-resource requests, with the lower case method as verb.
+func ParseKubernetesRequest(method string, u *url.URL) *KubernetesRequest {
+	parts := splitPath(u.Path)
+	result := &KubernetesRequest{Verb: strings.ToLower(method)}
+
+	switch {
+	case len(parts) >= 2 && parts[0] == "api":
+		result.APIVersion = parts[1]
+		parts = parts[2:]
+	case len(parts) >= 3 && parts[0] == "apis":
+		result.APIGroup, result.APIVersion = parts[1], parts[2]
+		parts = parts[3:]
+	default:
+		result.NonResource = true
+		return result
+	}
+
+	if len(parts) == 0 {
+		// discovery of the resources in the group version
+		result.NonResource = true
+		return result
+	}
+
+	watch := false
+	if parts[0] == "watch" {
+		watch = true
+		parts = parts[1:]
+		if len(parts) == 0 {
+			result.NonResource = true
+			return result
+		}
+	}
+
+	if len(parts) >= 3 && parts[0] == "namespaces" {
+		result.Namespace = parts[1]
+		parts = parts[2:]
+	} else if len(parts) >= 2 && parts[0] == "namespaces" {
+		// the namespace itself
+		result.Namespace = parts[1]
+	}
+
+	result.Resource = parts[0]
+	if len(parts) > 1 {
+		result.Name = parts[1]
+	}
+	if len(parts) > 2 {
+		result.Subresource = strings.Join(parts[2:], "/")
+	}
+
+	if query := u.Query().Get("watch"); query == "true" || query == "1" {
+		watch = true
+	}
+	result.Verb = resourceVerb(method, result.Name != "", watch)
+	return result
+}
+
+// resourceVerb returns the Kubernetes verb of a resource request
+func resourceVerb(method string, named bool, watch bool) string {
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		switch {
+		case watch:
+			return "watch"
+		case named:
+			return "get"
+		default:
+			return "list"
+		}
+	case http.MethodPost:
+		return "create"
+	case http.MethodPut:
+		return "update"
+	case http.MethodPatch:
+		return "patch"
+	case http.MethodDelete:
+		if named {
+			return "delete"
+		}
+		return "deletecollection"
+	default:
+		return strings.ToLower(method)
+	}
+}
+
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return []string{}
+	}
+	return strings.Split(path, "/")
+}
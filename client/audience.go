@@ -0,0 +1,231 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+)
+
+// audienceAuto is the --iap-audience value to discover the audience of the target url
+const audienceAuto = "auto"
+
+// iapSignInHost is the host to which IAP redirects unauthenticated requests
+const iapSignInHost = "accounts.google.com"
+
+// discoverAudience determines the OAuth client ID of the IAP protecting the target url, as lookupAudience does.
+// The result is cached in the user's cache directory.
+func (p *Proxy) discoverAudience(ctx context.Context, client *http.Client) (string, error) {
+	if audience := cachedAudience(p.TargetURL); audience != "" {
+		return audience, nil
+	}
+
+	audience, err := p.lookupAudience(ctx, client)
+	if err != nil {
+		return "", err
+	}
+	if err = storeAudience(p.TargetURL, audience); err != nil {
+		slog.Warn("failed to cache the IAP audience", "error", err)
+	}
+	return audience, nil
+}
+
+// lookupAudience determines the OAuth client ID of the IAP protecting the target url, without the cache. The
+// IAP sign-in redirect of an unauthenticated request is tried first, and then the IAP configuration of the
+// backend service of the load balancer.
+func (p *Proxy) lookupAudience(ctx context.Context, client *http.Client) (string, error) {
+	targetURL, err := url.Parse(p.TargetURL)
+	if err != nil || targetURL.Host == "" {
+		return "", fmt.Errorf("--iap-audience %s requires a valid --target-url", audienceAuto)
+	}
+
+	audience, err := discoverAudienceFromRedirect(client, targetURL)
+	if err != nil && p.credentials != nil && p.ProjectID != "" {
+		var backendErr error
+		audience, backendErr = discoverAudienceFromBackendService(ctx, p.credentials, p.ProjectID, targetURL)
+		if backendErr != nil {
+			err = fmt.Errorf("%s, and from the backend services of project %s, %s", err, p.ProjectID, backendErr)
+		} else {
+			err = nil
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to discover the IAP audience of %s, %s", p.TargetURL, err)
+	}
+	return audience, nil
+}
+
+// discoverAudienceFromRedirect returns the client_id of the IAP sign-in redirect for an unauthenticated request.
+// Only a redirect generated by IAP to the Google sign-in is accepted, so that the target cannot choose the audience.
+func discoverAudienceFromRedirect(client *http.Client, targetURL *url.URL) (string, error) {
+	probe := *client
+	probe.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	resp, err := probe.Get(targetURL.String())
+	if err != nil {
+		return "", fmt.Errorf("failed to probe the target, %s", err)
+	}
+	resp.Body.Close()
+
+	if resp.Header.Get("X-Goog-IAP-Generated-Response") != "true" {
+		return "", fmt.Errorf("the target did not respond via IAP, status %d", resp.StatusCode)
+	}
+	location, err := resp.Location()
+	if err != nil {
+		return "", fmt.Errorf("the target did not redirect to the IAP sign-in, status %d", resp.StatusCode)
+	}
+	if location.Host != iapSignInHost {
+		return "", fmt.Errorf("the target redirected to %s instead of the IAP sign-in on %s", location.Host, iapSignInHost)
+	}
+	clientID := location.Query().Get("client_id")
+	if clientID == "" {
+		return "", fmt.Errorf("the redirect of the target to %s has no client_id", location.Host)
+	}
+	return clientID, nil
+}
+
+// discoverAudienceFromBackendService returns the OAuth client ID of the IAP configuration of the backend service,
+// which serves the target host on the global load balancer with the ip address of the target.
+func discoverAudienceFromBackendService(ctx context.Context, credentials *google.Credentials, projectID string, targetURL *url.URL) (string, error) {
+	addresses, err := net.DefaultResolver.LookupHost(ctx, targetURL.Hostname())
+	if err != nil {
+		return "", err
+	}
+
+	service, err := compute.NewService(ctx, option.WithTokenSource(credentials.TokenSource))
+	if err != nil {
+		return "", err
+	}
+
+	var target string
+	err = service.GlobalForwardingRules.List(projectID).Pages(ctx, func(rules *compute.ForwardingRuleList) error {
+		for _, rule := range rules.Items {
+			for _, address := range addresses {
+				if rule.IPAddress == address && strings.Contains(rule.Target, "/targetHttpsProxies/") {
+					target = rule.Target
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to list the forwarding rules, %s", err)
+	}
+	if target == "" {
+		return "", fmt.Errorf("no https forwarding rule found for %s in project %s", targetURL.Hostname(), projectID)
+	}
+
+	proxy, err := service.TargetHttpsProxies.Get(projectID, path.Base(target)).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("failed to get target proxy %s, %s", path.Base(target), err)
+	}
+	urlMap, err := service.UrlMaps.Get(projectID, path.Base(proxy.UrlMap)).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("failed to get url map %s, %s", path.Base(proxy.UrlMap), err)
+	}
+
+	backend := backendServiceForHost(urlMap, targetURL.Hostname())
+	backendService, err := service.BackendServices.Get(projectID, path.Base(backend)).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("failed to get backend service %s, %s", path.Base(backend), err)
+	}
+	if backendService.Iap == nil || !backendService.Iap.Enabled || backendService.Iap.Oauth2ClientId == "" {
+		return "", fmt.Errorf("backend service %s has no IAP OAuth client configured", backendService.Name)
+	}
+	return backendService.Iap.Oauth2ClientId, nil
+}
+
+// backendServiceForHost returns the default backend service of the url map for the host
+func backendServiceForHost(urlMap *compute.UrlMap, host string) string {
+	for _, rule := range urlMap.HostRules {
+		for _, pattern := range rule.Hosts {
+			if pattern == "*" || pattern == host ||
+				strings.HasPrefix(pattern, "*") && strings.HasSuffix(host, pattern[1:]) {
+				for _, matcher := range urlMap.PathMatchers {
+					if matcher.Name == rule.PathMatcher {
+						return matcher.DefaultService
+					}
+				}
+			}
+		}
+	}
+	return urlMap.DefaultService
+}
+
+// audienceCacheFile returns the file in which the discovered audiences are cached
+func audienceCacheFile() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "simple-iap-proxy", "audiences.json"), nil
+}
+
+// readAudienceCache returns the cached audiences by target url
+func readAudienceCache() map[string]string {
+	audiences := make(map[string]string)
+	filename, err := audienceCacheFile()
+	if err != nil {
+		return audiences
+	}
+	if content, err := os.ReadFile(filename); err == nil {
+		_ = json.Unmarshal(content, &audiences)
+	}
+	return audiences
+}
+
+// cachedAudience returns the cached audience of the target url, or an empty string if unknown
+func cachedAudience(targetURL string) string {
+	return readAudienceCache()[targetURL]
+}
+
+// storeAudience caches the audience of the target url
+func storeAudience(targetURL, audience string) error {
+	return updateAudienceCache(func(audiences map[string]string) {
+		audiences[targetURL] = audience
+	})
+}
+
+// clearAudience removes the cached audience of the target url, so that it is discovered again
+func clearAudience(targetURL string) error {
+	return updateAudienceCache(func(audiences map[string]string) {
+		delete(audiences, targetURL)
+	})
+}
+
+// updateAudienceCache updates the cached audiences, while holding the lock on the cache file
+func updateAudienceCache(update func(audiences map[string]string)) error {
+	filename, err := audienceCacheFile()
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(filename), 0o700); err != nil {
+		return err
+	}
+	unlock, err := acquireFileLock(filename)
+	if err != nil {
+		return fmt.Errorf("failed to lock the audience cache, %s", err)
+	}
+	defer unlock()
+
+	audiences := readAudienceCache()
+	update(audiences)
+	content, err := json.Marshal(audiences)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, content, 0o600)
+}
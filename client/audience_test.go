@@ -0,0 +1,126 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"google.golang.org/api/compute/v1"
+)
+
+const testClientID = "1234567890-j9onig1ofcgle7iogv8fceu04v8hriuv.apps.googleusercontent.com"
+
+// newIAPStandIn mimics the sign-in redirect of IAP for unauthenticated requests
+func newIAPStandIn(t *testing.T) *httptest.Server {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Goog-IAP-Generated-Response", "true")
+		http.Redirect(w, r, "https://accounts.google.com/o/oauth2/v2/auth?client_id="+testClientID+
+			"&response_type=code&scope=openid+email&redirect_uri=https://"+r.Host+"/_gcp_gatekeeper/authenticate&state=abc",
+			http.StatusFound)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestDiscoverAudience(t *testing.T) {
+	isolateTokenCache(t)
+
+	iap := newIAPStandIn(t)
+	p := Proxy{TargetURL: iap.URL}
+
+	audience, err := p.discoverAudience(context.Background(), iap.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if audience != testClientID {
+		t.Fatalf("expected audience %s, got %s", testClientID, audience)
+	}
+
+	iap.Close()
+	if audience, err = p.discoverAudience(context.Background(), http.DefaultClient); err != nil {
+		t.Fatalf("expected the cached audience, got %s", err)
+	}
+	if audience != testClientID {
+		t.Fatalf("expected cached audience %s, got %s", testClientID, audience)
+	}
+}
+
+func TestDiscoverAudienceWithoutRedirect(t *testing.T) {
+	isolateTokenCache(t)
+
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(target.Close)
+
+	p := Proxy{TargetURL: target.URL}
+	if _, err := p.discoverAudience(context.Background(), target.Client()); err == nil {
+		t.Fatal("expected an error for a target which is not protected by IAP")
+	}
+}
+
+func TestBackendServiceForHost(t *testing.T) {
+	urlMap := &compute.UrlMap{
+		DefaultService: "global/backendServices/default",
+		HostRules: []*compute.HostRule{
+			{Hosts: []string{"iap-proxy.example.com"}, PathMatcher: "proxy"},
+			{Hosts: []string{"*.apps.example.com"}, PathMatcher: "apps"},
+		},
+		PathMatchers: []*compute.PathMatcher{
+			{Name: "proxy", DefaultService: "global/backendServices/iap-proxy"},
+			{Name: "apps", DefaultService: "global/backendServices/apps"},
+		},
+	}
+
+	for host, expected := range map[string]string{
+		"iap-proxy.example.com":    "global/backendServices/iap-proxy",
+		"httpbin.apps.example.com": "global/backendServices/apps",
+		"other.example.com":        "global/backendServices/default",
+	} {
+		if backend := backendServiceForHost(urlMap, host); backend != expected {
+			t.Errorf("expected backend service %s for %s, got %s", expected, host, backend)
+		}
+	}
+}
+
+func TestLookupAudienceIgnoresCache(t *testing.T) {
+	isolateTokenCache(t)
+
+	iap := newIAPStandIn(t)
+	p := Proxy{TargetURL: iap.URL}
+	if err := storeAudience(iap.URL, "stale-client-id"); err != nil {
+		t.Fatal(err)
+	}
+
+	audience, err := p.lookupAudience(context.Background(), iap.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if audience != testClientID {
+		t.Fatalf("expected audience %s instead of the cached one, got %s", testClientID, audience)
+	}
+}
+
+func TestDiscoverAudienceFromRedirectRequiresIAP(t *testing.T) {
+	for name, handler := range map[string]http.HandlerFunc{
+		"not generated by IAP": func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, "https://accounts.google.com/o/oauth2/v2/auth?client_id="+testClientID, http.StatusFound)
+		},
+		"not to the Google sign-in": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Goog-IAP-Generated-Response", "true")
+			http.Redirect(w, r, "https://sign-in.example.com/auth?client_id=attacker-client-id", http.StatusFound)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			target := httptest.NewTLSServer(handler)
+			t.Cleanup(target.Close)
+
+			targetURL, _ := url.Parse(target.URL)
+			if audience, err := discoverAudienceFromRedirect(target.Client(), targetURL); err == nil {
+				t.Errorf("expected an error, got audience %s", audience)
+			}
+		})
+	}
+}
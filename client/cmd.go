@@ -1,10 +1,12 @@
 package client
 
 import (
-	"log"
+	"strings"
+	"time"
 
 	"github.com/binxio/simple-iap-proxy/cmd"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 // NewClientCmd create a gke client command
@@ -22,18 +24,17 @@ certificates for the targeted hosts on the fly.`,
 		},
 	}
 	c.AddPersistentFlags()
-	c.Flags().StringVarP(&c.TargetURL, "target-url", "t", "", "to forward requests to")
-	c.Flags().StringVarP(&c.Audience, "iap-audience", "a", "", "of the IAP application")
-	c.Flags().StringVarP(&c.ServiceAccount, "service-account", "s", "", "to impersonate")
-	c.Flags().BoolVarP(&c.UseDefaultCredentials, "use-default-credentials", "u", false, "use default credentials instead of gcloud configuration")
-	c.Flags().StringVarP(&c.ConfigurationName, "configuration", "C", "", "name of gcloud configuration to use for credentials")
+	c.addTokenFlags(c.Flags())
 	c.Flags().BoolVarP(&c.ToGKEClusters, "to-gke", "G", false, "proxy to GKE clusters in the project")
 	c.Flags().StringSliceVarP(&c.HostNames, "to-host", "H", []string{}, "proxy to these hosts, specified as regular expression")
 	c.Flags().BoolVarP(&c.HTTPProtocol, "http-protocol", "", false, "proxy listens using HTTP instead of HTTPS")
-	if err := c.MarkFlagRequired("iap-audience"); err != nil {
-		log.Fatal(err)
-	}
-	c.MarkFlagRequired("service-account")
+	c.Flags().Int64VarP(&c.ReplayBodyLimit, "replay-body-limit", "", 1024*1024, "maximum size of a request body buffered to replay the request when IAP rejects the token")
+	c.Flags().StringVarP(&c.LeafKeyType, "leaf-key-type", "", "ecdsa-p256", "of the certificates generated for the targeted hosts, one of "+strings.Join(cmd.KeyTypes, ", "))
+	c.Flags().DurationVarP(&c.LeafValidity, "leaf-validity", "", 24*time.Hour, "of the certificates generated for the targeted hosts")
+	c.Flags().IntVarP(&c.LeafCacheSize, "leaf-cache-size", "", 1024, "maximum number of certificates generated for the targeted hosts to keep")
+	c.Flags().BoolVarP(&c.PregenerateLeaves, "pregenerate-leaves", "", false, "generate the certificates for all GKE cluster endpoints at startup and refresh")
+	c.AddMetricsFlags(c.Flags())
+	c.AddTracingFlags(c.Flags())
 	c.MarkFlagRequired("target-url")
 	c.Flags().SortFlags = false
 
@@ -43,3 +44,17 @@ certificates for the targeted hosts on the fly.`,
 
 	return &c.Command
 }
+
+// addTokenFlags adds the flags which determine how the IAP ID token is obtained
+func (p *Proxy) addTokenFlags(flags *pflag.FlagSet) {
+	flags.StringVarP(&p.TargetURL, "target-url", "t", "", "to forward requests to")
+	flags.StringVarP(&p.Audience, "iap-audience", "a", "", "of the IAP application, or auto to discover it from the target-url")
+	flags.StringVarP(&p.ServiceAccount, "service-account", "s", "", "to impersonate, defaults to the service account of the metadata server")
+	flags.StringArrayVarP(&p.Delegates, "delegate", "", []string{}, "service account in the delegation chain to the service account to impersonate, repeat in order")
+	flags.BoolVarP(&p.UseDefaultCredentials, "use-default-credentials", "u", false, "use default credentials instead of gcloud configuration")
+	flags.StringVarP(&p.CredentialsFile, "credentials-file", "", "", "service account key or external account configuration file to use for credentials")
+	flags.StringVarP(&p.ConfigurationName, "configuration", "C", "", "name of gcloud configuration to use for credentials")
+	flags.StringVarP(&p.IDTokenFile, "id-token-file", "", "", "file containing the ID token to use, re-read when changed")
+	flags.StringVarP(&p.IDTokenCommand, "id-token-command", "", "", "command printing the ID token to use, executed when the token is about to expire")
+	flags.BoolVarP(&p.NoTokenCache, "no-token-cache", "", false, "do not cache ID tokens on disk across restarts")
+}
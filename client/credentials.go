@@ -0,0 +1,83 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+
+	"golang.org/x/oauth2/google"
+)
+
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// serviceAccountImpersonationURL matches the service account in the impersonation url of an external account
+var serviceAccountImpersonationURL = regexp.MustCompile(`/serviceAccounts/([^/:]+):generateAccessToken$`)
+
+// credentialsFromFile reads a service account key or an external account configuration from file
+func credentialsFromFile(ctx context.Context, filename string) (*google.Credentials, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credentials file, %s", err)
+	}
+
+	switch credentialsType(content) {
+	case "service_account", "external_account":
+		break
+	case "":
+		return nil, fmt.Errorf("%s does not contain a credentials type", filename)
+	default:
+		return nil, fmt.Errorf("%s contains unsupported credentials of type %s", filename, credentialsType(content))
+	}
+
+	credentials, err := google.CredentialsFromJSON(ctx, content, cloudPlatformScope)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create credentials from %s, %s", filename, err)
+	}
+	return credentials, nil
+}
+
+// federatedCredentials returns the external account credentials without the service account impersonation,
+// together with the service account it impersonates. IAP ID tokens are obtained by impersonating this service
+// account with the federated token, as there is no ID token equivalent of the impersonated access token.
+// When another service account is specified, the credentials are returned with the impersonation, so that
+// the specified service account is impersonated via the service account of the configuration.
+func federatedCredentials(ctx context.Context, credentials *google.Credentials, serviceAccount string) (*google.Credentials, string, error) {
+	var config map[string]json.RawMessage
+	if err := json.Unmarshal(credentials.JSON, &config); err != nil {
+		return nil, "", fmt.Errorf("failed to parse external account configuration, %s", err)
+	}
+
+	var impersonationURL string
+	if raw, ok := config["service_account_impersonation_url"]; ok {
+		if err := json.Unmarshal(raw, &impersonationURL); err != nil {
+			return nil, "", fmt.Errorf("invalid service_account_impersonation_url, %s", err)
+		}
+	}
+	if impersonationURL == "" {
+		return credentials, "", nil
+	}
+
+	match := serviceAccountImpersonationURL.FindStringSubmatch(impersonationURL)
+	if match == nil {
+		return nil, "", fmt.Errorf("no service account found in impersonation url %s", impersonationURL)
+	}
+	if serviceAccount != "" && serviceAccount != match[1] {
+		return credentials, match[1], nil
+	}
+
+	delete(config, "service_account_impersonation_url")
+	delete(config, "service_account_impersonation")
+	content, err := json.Marshal(config)
+	if err != nil {
+		return nil, "", err
+	}
+
+	federated, err := google.CredentialsFromJSON(ctx, content, cloudPlatformScope)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create federated credentials, %s", err)
+	}
+	federated.ProjectID = credentials.ProjectID
+	return federated, match[1], nil
+}
@@ -0,0 +1,240 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+const testServiceAccount = "iap-accessor@my-project.iam.gserviceaccount.com"
+
+// newSTSStandIn mimics the Google STS, service account impersonation and OAuth2 token endpoints
+func newSTSStandIn(t *testing.T, subjectTokens chan<- string) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sts", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		subjectTokens <- r.PostForm.Get("subject_token")
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token":"federated-token","issued_token_type":"urn:ietf:params:oauth:token-type:access_token","token_type":"Bearer","expires_in":3600}`)
+	})
+	mux.HandleFunc("/v1/projects/-/serviceAccounts/"+testServiceAccount+":generateAccessToken", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer federated-token" {
+			http.Error(w, "not federated", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"accessToken":"impersonated-token","expireTime":"2099-01-01T00:00:00Z"}`)
+	})
+	mux.HandleFunc("/subject-token", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "url-subject-token")
+	})
+	mux.HandleFunc("/oauth2", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token":"service-account-token","token_type":"Bearer","expires_in":3600}`)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func writeJSON(t *testing.T, name string, content interface{}) string {
+	filename := filepath.Join(t.TempDir(), name)
+	data, err := json.Marshal(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filename, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func externalAccount(server *httptest.Server, credentialSource map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"type":                              "external_account",
+		"audience":                          "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/ci/providers/github",
+		"subject_token_type":                "urn:ietf:params:oauth:token-type:jwt",
+		"token_url":                         server.URL + "/sts",
+		"service_account_impersonation_url": server.URL + "/v1/projects/-/serviceAccounts/" + testServiceAccount + ":generateAccessToken",
+		"credential_source":                 credentialSource,
+	}
+}
+
+func TestGetCredentialsFromExternalAccount(t *testing.T) {
+	subjectTokens := make(chan string, 10)
+	server := newSTSStandIn(t, subjectTokens)
+
+	tokenFile := filepath.Join(t.TempDir(), "oidc-token")
+	if err := os.WriteFile(tokenFile, []byte("file-subject-token"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	script := filepath.Join(t.TempDir(), "subject-token.sh")
+	err := os.WriteFile(script, []byte(`#!/bin/sh
+echo '{"version":1,"success":true,"token_type":"urn:ietf:params:oauth:token-type:jwt","id_token":"executable-subject-token","expiration_time":4102444800}'
+`), 0o700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GOOGLE_EXTERNAL_ACCOUNT_ALLOW_EXECUTABLES", "1")
+
+	const otherServiceAccount = "other@my-project.iam.gserviceaccount.com"
+	tests := []struct {
+		name             string
+		credentialSource map[string]interface{}
+		subjectToken     string
+		serviceAccount   string
+	}{
+		{
+			name:             "file",
+			credentialSource: map[string]interface{}{"file": tokenFile},
+			subjectToken:     "file-subject-token",
+		},
+		{
+			name:             "url",
+			credentialSource: map[string]interface{}{"url": server.URL + "/subject-token"},
+			subjectToken:     "url-subject-token",
+		},
+		{
+			name:             "executable",
+			credentialSource: map[string]interface{}{"executable": map[string]interface{}{"command": script}},
+			subjectToken:     "executable-subject-token",
+		},
+		{
+			name:             "other service account",
+			credentialSource: map[string]interface{}{"file": tokenFile},
+			subjectToken:     "file-subject-token",
+			serviceAccount:   otherServiceAccount,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.name == "executable" && runtime.GOOS == "windows" {
+				t.Skip("executable-sourced credentials require a shell")
+			}
+			p := Proxy{
+				CredentialsFile: writeJSON(t, "credentials.json", externalAccount(server, tt.credentialSource)),
+				ServiceAccount:  tt.serviceAccount,
+			}
+			p.ProjectID = "my-project"
+
+			if err := p.getCredentials(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			expectedServiceAccount := testServiceAccount
+			if tt.serviceAccount != "" {
+				expectedServiceAccount = tt.serviceAccount
+			}
+			if p.ServiceAccount != expectedServiceAccount {
+				t.Errorf("expected service account %s, got %s", expectedServiceAccount, p.ServiceAccount)
+			}
+
+			token, err := p.credentials.TokenSource.Token()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token.AccessToken != "impersonated-token" {
+				t.Errorf("expected impersonated-token, got %s", token.AccessToken)
+			}
+			if subjectToken := <-subjectTokens; subjectToken != tt.subjectToken {
+				t.Errorf("expected subject token %s, got %s", tt.subjectToken, subjectToken)
+			}
+
+			token, err = p.impersonationCredentials.TokenSource.Token()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.serviceAccount != "" {
+				// the other service account is impersonated via the service account of the configuration
+				if token.AccessToken != "impersonated-token" {
+					t.Errorf("expected impersonated-token for impersonation, got %s", token.AccessToken)
+				}
+				return
+			}
+			if token.AccessToken != "federated-token" {
+				t.Errorf("expected federated-token for impersonation, got %s", token.AccessToken)
+			}
+			<-subjectTokens
+		})
+	}
+}
+
+func TestGetCredentialsFromServiceAccountKey(t *testing.T) {
+	server := newSTSStandIn(t, make(chan string, 1))
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := Proxy{
+		CredentialsFile: writeJSON(t, "key.json", map[string]interface{}{
+			"type":           "service_account",
+			"project_id":     "my-project",
+			"private_key_id": "1",
+			"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+			"client_email":   testServiceAccount,
+			"token_uri":      server.URL + "/oauth2",
+		}),
+	}
+
+	if err = p.getCredentials(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if p.ProjectID != "my-project" {
+		t.Errorf("expected project my-project, got %s", p.ProjectID)
+	}
+	if p.ServiceAccount != "" {
+		t.Errorf("expected no service account to impersonate, got %s", p.ServiceAccount)
+	}
+	token, err := p.impersonationCredentials.TokenSource.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "service-account-token" {
+		t.Errorf("expected service-account-token, got %s", token.AccessToken)
+	}
+}
+
+func TestProjectFlagOverridesCredentials(t *testing.T) {
+	server := newSTSStandIn(t, make(chan string, 1))
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := Proxy{
+		CredentialsFile: writeJSON(t, "key.json", map[string]interface{}{
+			"type":           "service_account",
+			"project_id":     "my-project",
+			"private_key_id": "1",
+			"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+			"client_email":   testServiceAccount,
+			"token_uri":      server.URL + "/oauth2",
+		}),
+	}
+	p.AddPersistentFlags()
+	if err = p.PersistentFlags().Parse([]string{"--project", "other-project"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = p.getCredentials(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if p.ProjectID != "other-project" {
+		t.Errorf("expected project other-project of --project, got %s", p.ProjectID)
+	}
+}
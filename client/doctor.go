@@ -0,0 +1,309 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/binxio/simple-iap-proxy/clusterinfo"
+	"github.com/spf13/cobra"
+	"golang.org/x/oauth2"
+)
+
+// DoctorCommand diagnoses the chain from the credentials via IAP to the gke-server
+type DoctorCommand struct {
+	Proxy
+}
+
+// NewDoctorCmd creates a doctor command
+func NewDoctorCmd() *cobra.Command {
+	c := DoctorCommand{}
+	c.Command = cobra.Command{
+		Use:   "doctor",
+		Short: "diagnoses the configuration of the client",
+		Long: `
+Checks each step of the chain from the credentials via IAP to the gke-server in order, and
+reports whether it passed or failed with a hint how to remedy the failure. Accepts the same
+flags as the client.
+`,
+	}
+	c.addTokenFlags(c.Flags())
+	c.Flags().StringVarP(&c.KeyFile, "key-file", "k", "", "key file for serving https")
+	c.Flags().StringVarP(&c.CertificateFile, "certificate-file", "c", "", "certificate of the server")
+	c.AddKeyPassphraseFlags(c.Flags())
+	c.Flags().BoolVarP(&c.ToGKEClusters, "to-gke", "G", false, "proxy to GKE clusters in the project")
+	c.Flags().StringVarP(&c.ProjectID, "project", "p", "", "google project id to use")
+	c.Flags().SortFlags = false
+	c.SilenceUsage = true
+
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		return c.Run()
+	}
+	return &c.Command
+}
+
+// diagnosis reports the results of the checks
+type diagnosis struct {
+	w      io.Writer
+	failed int
+}
+
+func (d *diagnosis) pass(check, detail string) {
+	fmt.Fprintf(d.w, "[PASS] %s: %s\n", check, detail)
+}
+
+func (d *diagnosis) fail(check string, err error, hint string) {
+	d.failed++
+	fmt.Fprintf(d.w, "[FAIL] %s: %s\n       hint: %s\n", check, err, hint)
+}
+
+func (d *diagnosis) skip(check, reason string) {
+	fmt.Fprintf(d.w, "[SKIP] %s: %s\n", check, reason)
+}
+
+// Run checks each step of the chain in order
+func (c *DoctorCommand) Run() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	if err := c.validateTokenOptions(); err != nil {
+		return err
+	}
+
+	d := &diagnosis{w: os.Stdout}
+	token := c.checkToken(ctx, d)
+	c.checkCertificate(d)
+	targetURL := c.checkTarget(d)
+	c.checkIAP(d, targetURL, token)
+	c.checkClusters(ctx, d)
+
+	if d.failed > 0 {
+		return fmt.Errorf("%d checks failed", d.failed)
+	}
+	return nil
+}
+
+// checkToken checks the credentials, project and ID token, and returns the token or nil if it could not be obtained
+func (c *DoctorCommand) checkToken(ctx context.Context, d *diagnosis) *oauth2.Token {
+	if c.hasProvidedIDToken() && !c.ToGKEClusters {
+		d.skip("credentials found", "the ID token is provided by --id-token-file or --id-token-command")
+		d.skip("project resolved", "no credentials are used")
+	} else {
+		if err := c.getCredentials(ctx); err != nil {
+			d.fail("credentials found", err,
+				"run `gcloud auth login`, or specify --credentials-file, --use-default-credentials or --configuration")
+			d.skip("project resolved", "no credentials")
+			d.skip("token minted", "no credentials")
+			d.skip("audience claim correct", "no token")
+			return nil
+		}
+		d.pass("credentials found", c.credentialsDescription())
+
+		if c.ProjectID == "" {
+			d.fail("project resolved", fmt.Errorf("the credentials have no default project"),
+				"specify --project, or set one with `gcloud config set project`")
+		} else {
+			d.pass("project resolved", c.ProjectID)
+		}
+	}
+
+	// the audience and token are obtained without the caches, so that the checks reflect what the
+	// credentials can do now, and not what they could do when the caches were filled
+	if c.Audience == audienceAuto {
+		audience, err := c.lookupAudience(ctx, http.DefaultClient)
+		if err != nil {
+			d.fail("audience discovered", err, "specify the OAuth client ID of the IAP with --iap-audience")
+			d.skip("token minted", "no audience")
+			d.skip("audience claim correct", "no audience")
+			return nil
+		}
+		c.Audience = audience
+		d.pass("audience discovered", audience)
+	}
+
+	c.NoTokenCache = true
+	tokenSource, err := c.createTokenSource(ctx)
+	var token *oauth2.Token
+	if err == nil {
+		token, err = tokenSource.Token()
+	}
+	if err != nil {
+		hint := "grant roles/iam.serviceAccountTokenCreator on the service account to the caller"
+		if c.hasProvidedIDToken() {
+			hint = "provide a valid ID token which has not expired"
+		} else if c.ServiceAccount == "" {
+			hint = "specify the --service-account to impersonate"
+		}
+		d.fail("token minted", err, hint)
+		d.skip("audience claim correct", "no token")
+		return nil
+	}
+
+	claims, err := parseIDTokenClaims(token.AccessToken)
+	if err != nil {
+		d.fail("token minted", err, "the ID token must be a JWT")
+		d.skip("audience claim correct", "no token")
+		return nil
+	}
+	d.pass("token minted", fmt.Sprintf("for %s, expires at %s", claims.Email, claims.Expiry().Format(time.RFC3339)))
+
+	switch {
+	case c.Audience == "":
+		d.skip("audience claim correct", "no --iap-audience specified")
+	case claims.Audience != c.Audience:
+		d.fail("audience claim correct", fmt.Errorf("the token audience %s does not match %s", claims.Audience, c.Audience),
+			"the --iap-audience must be the OAuth client ID of the IAP, try --iap-audience auto")
+	default:
+		d.pass("audience claim correct", claims.Audience)
+	}
+	return token
+}
+
+// credentialsDescription describes where the credentials were found
+func (c *DoctorCommand) credentialsDescription() string {
+	switch {
+	case c.CredentialsFile != "":
+		return fmt.Sprintf("%s credentials from %s", credentialsType(c.credentials.JSON), c.CredentialsFile)
+	case len(c.credentials.JSON) > 0:
+		return fmt.Sprintf("default %s credentials", credentialsType(c.credentials.JSON))
+	case c.UseDefaultCredentials:
+		return "default credentials of the metadata server"
+	case c.ConfigurationName != "":
+		return fmt.Sprintf("gcloud configuration %s", c.ConfigurationName)
+	default:
+		return "active gcloud configuration"
+	}
+}
+
+// checkCertificate checks that the key and certificate of the client can be loaded
+func (c *DoctorCommand) checkCertificate(d *diagnosis) {
+	if c.KeyFile == "" || c.CertificateFile == "" {
+		d.skip("CA files loadable", "no --key-file and --certificate-file specified, the client generates a certificate")
+		return
+	}
+	certificate, err := c.LoadCertificate()
+	if err != nil {
+		d.fail("CA files loadable", err, "generate a key and certificate with `simple-iap-proxy generate-certificate`")
+		return
+	}
+	if time.Now().After(certificate.Leaf.NotAfter) {
+		d.fail("CA files loadable", fmt.Errorf("the certificate expired at %s", certificate.Leaf.NotAfter.Format(time.RFC3339)),
+			"generate a new certificate with `simple-iap-proxy generate-certificate`")
+		return
+	}
+	d.pass("CA files loadable", fmt.Sprintf("%s, valid until %s", certificate.Leaf.Subject.CommonName, certificate.Leaf.NotAfter.Format(time.RFC3339)))
+}
+
+// checkTarget checks that the target url is reachable over TLS, and returns the url or nil if it is not
+func (c *DoctorCommand) checkTarget(d *diagnosis) *url.URL {
+	targetURL, err := url.Parse(c.TargetURL)
+	if err != nil || targetURL.Scheme != "https" {
+		d.fail("target reachable over TLS", fmt.Errorf("invalid target-url %q", c.TargetURL), "specify the https url of the IAP with --target-url")
+		return nil
+	}
+
+	address := targetURL.Host
+	if targetURL.Port() == "" {
+		address = net.JoinHostPort(targetURL.Hostname(), "443")
+	}
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", address, &tls.Config{ServerName: targetURL.Hostname()})
+	if err != nil {
+		d.fail("target reachable over TLS", err, "check the DNS record, load balancer and its certificate of the target-url")
+		return nil
+	}
+	defer conn.Close()
+	peer := conn.ConnectionState().PeerCertificates[0]
+	d.pass("target reachable over TLS", fmt.Sprintf("%s, certificate valid until %s", address, peer.NotAfter.Format(time.RFC3339)))
+	return targetURL
+}
+
+// checkIAP checks that IAP accepts the token, and that the gke-server behind it is healthy
+func (c *DoctorCommand) checkIAP(d *diagnosis, targetURL *url.URL, token *oauth2.Token) {
+	if targetURL == nil || token == nil {
+		d.skip("IAP accepts the token", "no target or token")
+		d.skip("gke-server healthy", "no target or token")
+		return
+	}
+
+	client := http.Client{Timeout: 30 * time.Second}
+	get := func(path string) (*http.Response, string, error) {
+		request, err := http.NewRequest(http.MethodGet, targetURL.JoinPath(path).String(), nil)
+		if err != nil {
+			return nil, "", err
+		}
+		setProxyAuthorization(request, token)
+		response, err := client.Do(request)
+		if err != nil {
+			return nil, "", err
+		}
+		defer response.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 4096))
+		return response, string(body), nil
+	}
+
+	response, _, err := get("/")
+	if err != nil {
+		d.fail("IAP accepts the token", err, "check the load balancer of the target-url")
+		d.skip("gke-server healthy", "IAP not reachable")
+		return
+	}
+	if isIAPRejection(response) {
+		d.fail("IAP accepts the token", fmt.Errorf("IAP rejected the token with status %d", response.StatusCode),
+			"grant roles/iap.httpsResourceAccessor on the IAP backend service to the token principal")
+		d.skip("gke-server healthy", "IAP rejected the token")
+		return
+	}
+	d.pass("IAP accepts the token", fmt.Sprintf("status %d", response.StatusCode))
+
+	if !c.ToGKEClusters {
+		d.skip("gke-server healthy", "no --to-gke specified")
+		return
+	}
+	response, body, err := get("/__ready")
+	if err == nil && response.StatusCode != http.StatusOK {
+		err = fmt.Errorf("status %d, %s", response.StatusCode, strings.TrimSpace(body))
+	}
+	if err != nil {
+		d.fail("gke-server healthy", err, "check the logs and health check of the gke-server instances behind the load balancer")
+		return
+	}
+	d.pass("gke-server healthy", strings.TrimSpace(body))
+}
+
+// checkClusters checks that the GKE clusters in the project can be listed
+func (c *DoctorCommand) checkClusters(ctx context.Context, d *diagnosis) {
+	if !c.ToGKEClusters {
+		d.skip("clusters listed", "no --to-gke specified")
+		return
+	}
+	if c.credentials == nil || c.ProjectID == "" {
+		d.skip("clusters listed", "no credentials or project")
+		return
+	}
+
+	clusterCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	cache, err := clusterinfo.NewCache(clusterCtx, c.ProjectID, c.credentials, time.Hour)
+	if err != nil {
+		d.fail("clusters listed", err, "grant roles/container.clusterViewer in the project to the caller")
+		return
+	}
+	clusters := cache.GetMap()
+	if len(*clusters) == 0 {
+		d.fail("clusters listed", fmt.Errorf("no running clusters found in project %s", c.ProjectID),
+			"specify the --project of the GKE clusters")
+		return
+	}
+	names := make([]string, 0, len(*clusters))
+	for _, cluster := range *clusters {
+		names = append(names, cluster.Name)
+	}
+	d.pass("clusters listed", strings.Join(names, ", "))
+}
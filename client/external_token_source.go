@@ -0,0 +1,96 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// fileTokenSource provides the ID token stored in a file, which is re-read when the file changes
+type fileTokenSource struct {
+	filename string
+	mutex    sync.Mutex
+	modTime  time.Time
+	size     int64
+	token    *oauth2.Token
+}
+
+func newFileTokenSource(filename string) *fileTokenSource {
+	return &fileTokenSource{filename: filename}
+}
+
+// Token returns the ID token from the file
+func (s *fileTokenSource) Token() (*oauth2.Token, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	info, err := os.Stat(s.filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ID token file, %s", err)
+	}
+
+	if s.token == nil || !info.ModTime().Equal(s.modTime) || info.Size() != s.size {
+		content, err := os.ReadFile(s.filename)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ID token file, %s", err)
+		}
+		token, err := tokenFromIDToken(strings.TrimSpace(string(content)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid ID token in %s, %s", s.filename, err)
+		}
+		s.token, s.modTime, s.size = token, info.ModTime(), info.Size()
+	}
+
+	if !s.token.Valid() {
+		return nil, fmt.Errorf("the ID token in %s expired at %s", s.filename, s.token.Expiry.Format(time.RFC3339))
+	}
+	return s.token, nil
+}
+
+// Invalidate forces the file to be read again, as it may have been replaced with the same modification time
+func (s *fileTokenSource) Invalidate(token *oauth2.Token) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.token = nil
+}
+
+// commandTokenSource provides the ID token printed on stdout by a command
+type commandTokenSource struct {
+	command string
+}
+
+// newCommandTokenSource returns a token source which executes the command when the token is about to expire
+func newCommandTokenSource(command string) *cachedTokenSource {
+	tokenSource := commandTokenSource{command: command}
+	return newCachedTokenSource(tokenSource, func() (oauth2.TokenSource, error) { return tokenSource, nil }, nil)
+}
+
+// Token executes the command to obtain a new ID token
+func (s commandTokenSource) Token() (*oauth2.Token, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", s.command)
+	} else {
+		cmd = exec.Command("/bin/sh", "-c", s.command)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ID token command failed, %s %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	token, err := tokenFromIDToken(strings.TrimSpace(stdout.String()))
+	if err != nil {
+		return nil, fmt.Errorf("ID token command returned an invalid token, %s", err)
+	}
+	return token, nil
+}
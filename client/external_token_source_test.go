@@ -0,0 +1,173 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// newTestIDToken returns an unsigned JWT with the specified audience and expiry
+func newTestIDToken(audience string, expiry time.Time) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(
+		`{"iss":"https://accounts.google.com","aud":%q,"email":"iap-accessor@my-project.iam.gserviceaccount.com","exp":%d}`,
+		audience, expiry.Unix())))
+	return header + "." + claims + ".c2lnbmF0dXJl"
+}
+
+// writeTestCertificate writes a self-signed certificate and key into a temporary directory
+func writeTestCertificate(t *testing.T) (keyFile, certificateFile string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "simple-iap-proxy"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	keyFile, certificateFile = filepath.Join(dir, "server.key"), filepath.Join(dir, "server.crt")
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(certificateFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return keyFile, certificateFile
+}
+
+func TestFileTokenSource(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "id-token")
+	first := newTestIDToken("first", time.Now().Add(time.Hour))
+	if err := os.WriteFile(filename, []byte(first+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	source := newFileTokenSource(filename)
+	token, err := source.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != first {
+		t.Fatalf("expected the token from file, got %s", token.AccessToken)
+	}
+
+	second := newTestIDToken("second-audience", time.Now().Add(2*time.Hour))
+	if err = os.WriteFile(filename, []byte(second), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if token, err = source.Token(); err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != second {
+		t.Fatalf("expected the changed token from file, got %s", token.AccessToken)
+	}
+
+	expired := newTestIDToken("third-audience-expired", time.Now().Add(-time.Minute))
+	if err = os.WriteFile(filename, []byte(expired), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = source.Token(); err == nil {
+		t.Fatal("expected an error for an expired token")
+	}
+}
+
+func TestCommandTokenSource(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test requires a shell")
+	}
+	counter := filepath.Join(t.TempDir(), "counter")
+	idToken := newTestIDToken("audience", time.Now().Add(time.Hour))
+	source := newCommandTokenSource(fmt.Sprintf("echo >> %s; echo %s", counter, idToken))
+
+	for i := 0; i < 3; i++ {
+		token, err := source.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token.AccessToken != idToken {
+			t.Fatalf("expected the token printed by the command, got %s", token.AccessToken)
+		}
+	}
+	if content, _ := os.ReadFile(counter); len(content) != 1 {
+		t.Fatalf("expected the command to be executed once, got %d", len(content))
+	}
+
+	if _, err := newCommandTokenSource("exit 1").Token(); err == nil {
+		t.Fatal("expected an error for a failing command")
+	}
+}
+
+func TestProxyWithIDTokenFile(t *testing.T) {
+	idToken := newTestIDToken("audience", time.Now().Add(time.Hour))
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "Bearer "+idToken {
+			http.Error(w, "invalid IAP token", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, "%s %s", r.Host, r.URL.Path)
+	}))
+	t.Cleanup(target.Close)
+
+	tokenFile := filepath.Join(t.TempDir(), "id-token")
+	if err := os.WriteFile(tokenFile, []byte(idToken), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	p := Proxy{
+		TargetURL:     target.URL,
+		IDTokenFile:   tokenFile,
+		HostNames:     []string{`^backend\.internal$`},
+		LeafKeyType:   "ecdsa-p256",
+		LeafValidity:  30 * time.Minute,
+		LeafCacheSize: 16,
+	}
+	p.KeyFile, p.CertificateFile = writeTestCertificate(t)
+	if err := p.initialize(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := httptest.NewServer(p.createProxy())
+	t.Cleanup(proxy.Close)
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	response, err := client.Get("http://backend.internal/api/v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(response.Body)
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", response.StatusCode, body)
+	}
+	if string(body) != "backend.internal /api/v1" {
+		t.Fatalf("expected the request for backend.internal to be forwarded, got %q", body)
+	}
+}
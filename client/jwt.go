@@ -0,0 +1,79 @@
+package client
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// idTokenClaims are the claims of an ID token relevant to IAP
+type idTokenClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	Audience  string `json:"aud"`
+	Email     string `json:"email"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// Expiry returns the expiry time of the token
+func (c *idTokenClaims) Expiry() time.Time {
+	return time.Unix(c.ExpiresAt, 0)
+}
+
+// decodeJWTSegment decodes a base64url encoded JSON segment of a JWT into v
+func decodeJWTSegment(segment string, v interface{}) error {
+	content, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
+
+// parseIDTokenClaims returns the claims of the ID token, without verifying the signature
+func parseIDTokenClaims(idToken string) (*idTokenClaims, error) {
+	segments := strings.Split(idToken, ".")
+	if len(segments) != 3 {
+		return nil, fmt.Errorf("ID token is not a JWT")
+	}
+	var claims idTokenClaims
+	if err := decodeJWTSegment(segments[1], &claims); err != nil {
+		return nil, fmt.Errorf("failed to decode ID token claims, %s", err)
+	}
+	if claims.ExpiresAt == 0 {
+		return nil, fmt.Errorf("ID token has no exp claim")
+	}
+	return &claims, nil
+}
+
+// decodeJWT returns the header and all claims of the JWT, without verifying the signature
+func decodeJWT(token string) (header, claims map[string]interface{}, err error) {
+	segments := strings.Split(token, ".")
+	if len(segments) != 3 {
+		return nil, nil, fmt.Errorf("ID token is not a JWT")
+	}
+	if err = decodeJWTSegment(segments[0], &header); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode ID token header, %s", err)
+	}
+	if err = decodeJWTSegment(segments[1], &claims); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode ID token claims, %s", err)
+	}
+	return header, claims, nil
+}
+
+// tokenFromIDToken returns an oauth2 token for the ID token, which expires at the exp claim
+func tokenFromIDToken(idToken string) (*oauth2.Token, error) {
+	claims, err := parseIDTokenClaims(idToken)
+	if err != nil {
+		return nil, err
+	}
+	return &oauth2.Token{
+		AccessToken: idToken,
+		TokenType:   "Bearer",
+		Expiry:      claims.Expiry(),
+	}, nil
+}
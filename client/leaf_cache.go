@@ -0,0 +1,237 @@
+package client
+
+import (
+	"container/list"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/binxio/simple-iap-proxy/clusterinfo"
+	"github.com/binxio/simple-iap-proxy/cmd"
+	"github.com/elazarl/goproxy"
+	"golang.org/x/sync/singleflight"
+)
+
+// leafCache signs certificates for the targeted hosts with the CA, and keeps the most recently used ones until
+// they are about to expire. The key type of the leaf certificates is independent of the key type of the CA.
+type leafCache struct {
+	ca       *tls.Certificate
+	keyType  string
+	validity time.Duration
+	size     int
+	mutex    sync.Mutex
+	entries  map[string]*list.Element
+	lru      *list.List
+	signing  singleflight.Group
+}
+
+// leafCacheEntry is the certificate of a host, which is renewed after renewAt
+type leafCacheEntry struct {
+	hostname    string
+	certificate *tls.Certificate
+	renewAt     time.Time
+}
+
+func newLeafCache(ca *tls.Certificate, keyType string, validity time.Duration, size int) *leafCache {
+	return &leafCache{
+		ca:       ca,
+		keyType:  keyType,
+		validity: validity,
+		size:     size,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// SetCA replaces the CA to sign with, and drops the certificates signed by the previous one
+func (c *leafCache) SetCA(ca *tls.Certificate) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.ca = ca
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+}
+
+// Get returns the certificate for the host, signing a new one if it is not cached or about to expire. Concurrent
+// requests for the same host wait for a single certificate to be signed.
+func (c *leafCache) Get(hostname string) (*tls.Certificate, error) {
+	if certificate := c.lookup(hostname); certificate != nil {
+		return certificate, nil
+	}
+
+	certificate, err, _ := c.signing.Do(hostname, func() (interface{}, error) {
+		if certificate := c.lookup(hostname); certificate != nil {
+			return certificate, nil
+		}
+		ca := c.currentCA()
+		certificate, notAfter, err := c.sign(ca, hostname)
+		if err != nil {
+			return nil, err
+		}
+		c.store(ca, hostname, certificate, notAfter)
+		return certificate, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return certificate.(*tls.Certificate), nil
+}
+
+// Pregenerate signs certificates for the hosts which are not cached yet
+func (c *leafCache) Pregenerate(hostnames []string) {
+	for _, hostname := range hostnames {
+		if _, err := c.Get(hostname); err != nil {
+			slog.Warn("failed to generate certificate", "host", hostname, "error", err)
+		}
+	}
+}
+
+// TLSConfig returns the goproxy TLS configuration function, which serves the certificates from the cache
+func (c *leafCache) TLSConfig() func(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error) {
+	return func(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error) {
+		hostname, _, err := net.SplitHostPort(host)
+		if err != nil {
+			hostname = host
+		}
+		certificate, err := c.Get(hostname)
+		if err != nil {
+			ctx.Warnf("Cannot sign host certificate with provided CA: %s", err)
+			return nil, err
+		}
+		return &tls.Config{
+			InsecureSkipVerify: true,
+			Certificates:       []tls.Certificate{*certificate},
+		}, nil
+	}
+}
+
+func (c *leafCache) lookup(hostname string) *tls.Certificate {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.entries[hostname]
+	if !ok {
+		return nil
+	}
+	entry := element.Value.(*leafCacheEntry)
+	if time.Now().After(entry.renewAt) {
+		c.lru.Remove(element)
+		delete(c.entries, hostname)
+		return nil
+	}
+	c.lru.MoveToFront(element)
+	return entry.certificate
+}
+
+func (c *leafCache) currentCA() *tls.Certificate {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.ca
+}
+
+// store the certificate of the host, unless the CA it was signed with has been replaced in the meantime
+func (c *leafCache) store(ca *tls.Certificate, hostname string, certificate *tls.Certificate, notAfter time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if ca != c.ca {
+		return
+	}
+
+	entry := &leafCacheEntry{
+		hostname:    hostname,
+		certificate: certificate,
+		renewAt:     notAfter.Add(-c.validity / 10),
+	}
+	if element, ok := c.entries[hostname]; ok {
+		element.Value = entry
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.entries[hostname] = c.lru.PushFront(entry)
+
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*leafCacheEntry).hostname)
+	}
+}
+
+// sign creates a certificate for the host, valid for the configured validity but not beyond the CA
+func (c *leafCache) sign(ca *tls.Certificate, hostname string) (*tls.Certificate, time.Time, error) {
+	key, err := cmd.GenerateKey(c.keyType)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to generate serial number, %s", err)
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: hostname},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(c.validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	if template.NotAfter.After(ca.Leaf.NotAfter) {
+		template.NotAfter = ca.Leaf.NotAfter
+	}
+	if ip := net.ParseIP(hostname); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{hostname}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Leaf, key.Public(), ca.PrivateKey)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to sign certificate for %s, %s", hostname, err)
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der, ca.Certificate[0]},
+		PrivateKey:  key,
+	}, template.NotAfter, nil
+}
+
+// pregenerateLeaves signs the certificates for all cluster endpoints, and again at every interval to renew them
+// before they expire, as the certificates of clusters which do not change are not renewed otherwise. The
+// endpoints of clusters which are added or changed on a refresh of the cluster information are signed right away.
+func (p *Proxy) pregenerateLeaves(ctx context.Context, interval time.Duration) {
+	unsubscribe := p.clusterInfo.Subscribe(func(event clusterinfo.Event) {
+		if event.Type != clusterinfo.Removed {
+			go p.leafCache.Pregenerate([]string{event.Cluster.Endpoint})
+		}
+	})
+	defer unsubscribe()
+
+	for {
+		endpoints := make([]string, 0)
+		for endpoint := range *p.clusterInfo.GetMap() {
+			endpoints = append(endpoints, endpoint)
+		}
+		p.leafCache.Pregenerate(endpoints)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
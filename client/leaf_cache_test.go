@@ -0,0 +1,87 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/binxio/simple-iap-proxy/cmd"
+)
+
+func TestLeafCache(t *testing.T) {
+	keyFile, certificateFile := writeTestCertificate(t)
+	ca, err := cmd.LoadCertificate(keyFile, certificateFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+
+	cache := newLeafCache(ca, "ed25519", time.Hour, 2)
+	first, err := cache.Get("a.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(first.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = leaf.Verify(x509.VerifyOptions{DNSName: "a.example.com", Roots: roots}); err != nil {
+		t.Fatalf("expected the leaf to be signed by the CA, %s", err)
+	}
+	if leaf.NotAfter.After(ca.Leaf.NotAfter) {
+		t.Errorf("expected the leaf not to outlive the CA")
+	}
+
+	if again, _ := cache.Get("a.example.com"); again != first {
+		t.Errorf("expected the cached certificate for a.example.com")
+	}
+
+	cache.Pregenerate([]string{"b.example.com", "10.0.0.1"})
+	if cache.lru.Len() != 2 {
+		t.Fatalf("expected the cache to hold 2 certificates, got %d", cache.lru.Len())
+	}
+	if _, ok := cache.entries["a.example.com"]; ok {
+		t.Errorf("expected the least recently used certificate to be evicted")
+	}
+
+	expiring := cache.entries["b.example.com"].Value.(*leafCacheEntry)
+	expiring.renewAt = time.Now().Add(-time.Second)
+	if renewed, _ := cache.Get("b.example.com"); renewed == nil || renewed == expiring.certificate {
+		t.Errorf("expected a new certificate for b.example.com")
+	}
+}
+
+func TestLeafCacheSignsOnce(t *testing.T) {
+	keyFile, certificateFile := writeTestCertificate(t)
+	ca, err := cmd.LoadCertificate(keyFile, certificateFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache := newLeafCache(ca, "rsa2048", 30*time.Minute, 2)
+	certificates := make(chan *tls.Certificate, 8)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(certificates); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			certificate, err := cache.Get("a.example.com")
+			if err != nil {
+				t.Error(err)
+			}
+			certificates <- certificate
+		}()
+	}
+	wg.Wait()
+	close(certificates)
+
+	first := <-certificates
+	for certificate := range certificates {
+		if certificate != first {
+			t.Fatalf("expected concurrent requests for the same host to share a single certificate")
+		}
+	}
+}
@@ -3,60 +3,134 @@ package client
 import (
 	"context"
 	"crypto/tls"
+	"encoding/pem"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"regexp"
+	"syscall"
 	"time"
 
 	"github.com/binxio/gcloudconfig"
 	"github.com/binxio/simple-iap-proxy/clusterinfo"
 	"github.com/binxio/simple-iap-proxy/cmd"
+	"github.com/binxio/simple-iap-proxy/logging"
+	"github.com/binxio/simple-iap-proxy/metrics"
+	"github.com/binxio/simple-iap-proxy/requestid"
+	"github.com/binxio/simple-iap-proxy/tracing"
 	"github.com/elazarl/goproxy"
-	"golang.org/x/oauth2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/oauth2/google"
-	"google.golang.org/api/impersonate"
-	"google.golang.org/api/option"
 )
 
+// caCertificatePath is the path on which the client serves the CA certificate
+const caCertificatePath = "/__ca.pem"
+
+// clusterInfoRefresh is the interval at which the cluster information is refreshed
+const clusterInfoRefresh = 5 * time.Minute
+
 // Proxy for GKE private master endpoints
 type Proxy struct {
 	cmd.RootCommand
-	Audience              string
-	ServiceAccount        string
-	ConfigurationName     string
-	UseDefaultCredentials bool
-	TargetURL             string
-	ProjectID             string
-	ToGKEClusters         bool
-	HostNames             []string
-	HTTPProtocol          bool
-	targetURL             *url.URL
-	credentials           *google.Credentials
-	tokenSource           oauth2.TokenSource
-	certificate           *tls.Certificate
-	clusterInfo           *clusterinfo.Cache
-	hostNames             []*regexp.Regexp
+	Audience                 string
+	ServiceAccount           string
+	Delegates                []string
+	ConfigurationName        string
+	UseDefaultCredentials    bool
+	CredentialsFile          string
+	IDTokenFile              string
+	IDTokenCommand           string
+	NoTokenCache             bool
+	TargetURL                string
+	ToGKEClusters            bool
+	HostNames                []string
+	HTTPProtocol             bool
+	ReplayBodyLimit          int64
+	LeafKeyType              string
+	LeafValidity             time.Duration
+	LeafCacheSize            int
+	PregenerateLeaves        bool
+	targetURL                *url.URL
+	audienceDiscovered       bool
+	credentials              *google.Credentials
+	metadataCredentials      bool
+	impersonationCredentials *google.Credentials
+	tokenSource              idTokenSource
+	certificate              *cmd.ReloadingCertificate
+	leafCache                *leafCache
+	clusterInfo              *clusterinfo.Cache
+	hostNames                []*regexp.Regexp
 }
 
 // Run the proxy until stopped
 func (p *Proxy) Run() error {
-	var err error
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	if p.UseDefaultCredentials && p.ConfigurationName != "" {
-		return fmt.Errorf("specify either --use-default-credentials or --configuration, not both")
+	shutdown, err := tracing.Start(ctx, "simple-iap-proxy-client", p.Tracing)
+	if err != nil {
+		return err
+	}
+	defer shutdown()
+
+	if err := p.initialize(ctx); err != nil {
+		return err
+	}
+
+	if p.clusterInfo != nil {
+		metrics.RegisterClusterCache(p.clusterInfo)
+	}
+	metrics.ListenAndServe(ctx, p.MetricsAddress)
+
+	proxy := p.createProxy()
+
+	scheme := "https"
+	if p.HTTPProtocol {
+		scheme = "http"
+	}
+	slog.Info("the CA certificate of the proxy is available", "url", fmt.Sprintf("%s://localhost:%d%s", scheme, p.Port, caCertificatePath))
+
+	srv := &http.Server{
+		Handler:      proxy,
+		Addr:         fmt.Sprintf(":%d", p.Port),
+		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+	}
+
+	if p.HTTPProtocol {
+		// I could not get the proxy on MacOS configured to connect using HTTPS :-(
+		return srv.ListenAndServe()
 	}
+	srv.TLSConfig = &tls.Config{GetCertificate: p.certificate.GetCertificate}
+	return srv.ListenAndServeTLS("", "")
+}
+
+// initialize validates the configuration, and obtains the certificate, credentials and ID token source
+func (p *Proxy) initialize(ctx context.Context) error {
+	var err error
 
 	if !p.ToGKEClusters && len(p.HostNames) == 0 {
 		return fmt.Errorf("at least --proxy-to or --proxy-to-gke must be specified")
 	}
 
-	p.certificate, err = loadCertificate(p.KeyFile, p.CertificateFile)
+	p.certificate, err = p.NewReloadingCertificate(ctx)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
+	if _, err = cmd.GenerateKey(p.LeafKeyType); err != nil {
+		return fmt.Errorf("invalid leaf-key-type, %s", err)
+	}
+	if p.LeafValidity <= 0 {
+		return fmt.Errorf("leaf-validity must be positive")
+	}
+	if remaining := time.Until(p.certificate.Certificate().Leaf.NotAfter); p.LeafValidity > remaining {
+		return fmt.Errorf("leaf-validity %s exceeds the remaining validity %s of the CA", p.LeafValidity, remaining.Round(time.Second))
+	}
+	p.leafCache = newLeafCache(p.certificate.Certificate(), p.LeafKeyType, p.LeafValidity, p.LeafCacheSize)
+	p.certificate.OnReload(p.leafCache.SetCA)
+
 	p.targetURL, err = url.Parse(p.TargetURL)
 	if err != nil {
 		return fmt.Errorf("invalid target-url %s, %s", p.TargetURL, err)
@@ -66,19 +140,22 @@ func (p *Proxy) Run() error {
 		return fmt.Errorf("target-url must be https")
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	err = p.getCredentials(ctx)
-	if err != nil {
-		return fmt.Errorf("%s", err)
+	if err = p.initializeTokenSource(ctx); err != nil {
+		return err
 	}
 
 	if p.ToGKEClusters {
-		p.clusterInfo, err = clusterinfo.NewCache(ctx, p.ProjectID, p.credentials, 5*time.Minute)
+		if p.ProjectID == "" {
+			return fmt.Errorf("specify a --project as there is no default one")
+		}
+		p.clusterInfo, err = clusterinfo.NewCache(ctx, p.ProjectID, p.credentials, clusterInfoRefresh)
 		if err != nil {
 			return fmt.Errorf("%s", err)
 		}
+		go p.clusterInfo.RefreshOnSignal(ctx, syscall.SIGHUP)
+		if p.PregenerateLeaves {
+			go p.pregenerateLeaves(ctx, clusterInfoRefresh)
+		}
 	}
 
 	p.hostNames = make([]*regexp.Regexp, 0, len(p.HostNames))
@@ -90,60 +167,98 @@ func (p *Proxy) Run() error {
 		p.hostNames = append(p.hostNames, e)
 	}
 
-	tokenConfig := impersonate.IDTokenConfig{
-		TargetPrincipal: p.ServiceAccount,
-		Audience:        p.Audience,
-		IncludeEmail:    true,
+	_, err = p.tokenSource.Token()
+	if err != nil {
+		return fmt.Errorf("failed to obtain an ID token for audience %s, %s",
+			p.Audience, err)
 	}
+	return nil
+}
 
-	p.tokenSource, err = impersonate.IDTokenSource(
-		ctx,
-		tokenConfig,
-		option.WithTokenSource(p.credentials.TokenSource),
-	)
+// initializeTokenSource validates the credential options, and obtains the credentials and ID token source
+func (p *Proxy) initializeTokenSource(ctx context.Context) error {
+	var err error
 
-	if err != nil {
-		return fmt.Errorf("failed to create a token source for %s with audience %s, %s",
-			p.ServiceAccount, p.Audience, err)
+	if err = p.validateTokenOptions(); err != nil {
+		return err
 	}
 
-	_, err = p.tokenSource.Token()
-	if err != nil {
-		return fmt.Errorf("failed to obtain token for %s, %s",
-			p.ServiceAccount, err)
+	if !p.hasProvidedIDToken() || p.ToGKEClusters {
+		err = p.getCredentials(ctx)
+		if err != nil {
+			return fmt.Errorf("%s", err)
+		}
 	}
 
-	proxy := p.createProxy()
+	if p.Audience == audienceAuto {
+		p.Audience, err = p.discoverAudience(ctx, http.DefaultClient)
+		if err != nil {
+			return err
+		}
+		p.audienceDiscovered = true
+		slog.Info("discovered IAP audience", "audience", p.Audience)
+	}
 
-	srv := &http.Server{
-		Handler:      proxy,
-		Addr:         fmt.Sprintf(":%d", p.Port),
-		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+	p.tokenSource, err = p.createTokenSource(ctx)
+	return err
+}
+
+// validateTokenOptions checks that the options to obtain the ID token are consistent
+func (p *Proxy) validateTokenOptions() error {
+	if p.UseDefaultCredentials && p.ConfigurationName != "" {
+		return fmt.Errorf("specify either --use-default-credentials or --configuration, not both")
 	}
 
-	if p.HTTPProtocol {
-		// I could not get the proxy on MacOS configured to connect using HTTPS :-(
-		return srv.ListenAndServe()
+	if p.CredentialsFile != "" && (p.UseDefaultCredentials || p.ConfigurationName != "") {
+		return fmt.Errorf("specify either --credentials-file, --use-default-credentials or --configuration")
+	}
+
+	if p.IDTokenFile != "" && p.IDTokenCommand != "" {
+		return fmt.Errorf("specify either --id-token-file or --id-token-command, not both")
 	}
-	return srv.ListenAndServeTLS(p.CertificateFile, p.KeyFile)
+
+	if p.Audience == "" && !p.hasProvidedIDToken() {
+		return fmt.Errorf("--iap-audience is required")
+	}
+	return nil
+}
+
+// hasProvidedIDToken returns true if the ID token is provided by a file or command, instead of obtained from credentials
+func (p *Proxy) hasProvidedIDToken() bool {
+	return p.IDTokenFile != "" || p.IDTokenCommand != ""
 }
 
 func (p *Proxy) getCredentials(ctx context.Context) error {
 	var err error
 
-	if p.UseDefaultCredentials || !gcloudconfig.IsGCloudOnPath() {
-		p.credentials, err = google.FindDefaultCredentials(ctx, "https://www.googleapis.com/auth/cloud-platform")
-	} else {
+	switch {
+	case p.CredentialsFile != "":
+		p.credentials, err = credentialsFromFile(ctx, p.CredentialsFile)
+	case p.UseDefaultCredentials || !gcloudconfig.IsGCloudOnPath():
+		p.credentials, err = google.FindDefaultCredentials(ctx, cloudPlatformScope)
+		// without a credentials file, the default credentials are those of the metadata server
+		p.metadataCredentials = err == nil && len(p.credentials.JSON) == 0
+	default:
 		p.credentials, err = gcloudconfig.GetCredentials(p.ConfigurationName)
 	}
 	if err != nil {
 		return fmt.Errorf("failed to obtain credentials, %s", err)
 	}
-	if p.ProjectID == "" {
-		p.ProjectID = p.credentials.ProjectID
+
+	p.impersonationCredentials = p.credentials
+	if credentialsType(p.credentials.JSON) == "external_account" {
+		var serviceAccount string
+		p.impersonationCredentials, serviceAccount, err = federatedCredentials(ctx, p.credentials, p.ServiceAccount)
+		if err != nil {
+			return err
+		}
+		if p.ServiceAccount == "" {
+			p.ServiceAccount = serviceAccount
+		}
 	}
+
 	if p.ProjectID == "" {
-		return fmt.Errorf("specify a --project as there is no default one")
+		p.ProjectID = p.credentials.ProjectID
 	}
 	return nil
 }
@@ -151,7 +266,8 @@ func (p *Proxy) getCredentials(ctx context.Context) error {
 // IsAllowedProxyEndpoint return true if the request is targets an allowed proxy endpoint
 func (p *Proxy) IsAllowedProxyEndpoint() goproxy.ReqConditionFunc {
 	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
-		return p.clusterInfo != nil && p.clusterInfo.GetConnectInfoForEndpoint(req.URL.Host) != nil || goproxy.ReqHostMatches(p.hostNames...).HandleReq(req, ctx)
+		return goproxy.ReqHostMatches(p.hostNames...).HandleReq(req, ctx) ||
+			p.clusterInfo != nil && p.clusterInfo.GetConnectInfoOrRefresh(req.URL.Host) != nil
 	}
 }
 
@@ -188,32 +304,82 @@ func removeProxyHeaders(ctx *goproxy.ProxyCtx, r *http.Request) {
 
 // OnRequest inserts the IAP required token and renames an existing Authorization header
 func (p *Proxy) OnRequest(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
-	log.Printf("on request to %s", r.URL)
+	slog.Debug("on request", "url", r.URL.String())
+	id := requestid.Ensure(r)
+	state := &requestState{id: id, start: time.Now(), target: p.targetName(r)}
+	ctx.UserData = state
+	r, state.span = tracing.StartSpan(r, "proxy "+r.Method, trace.SpanKindClient,
+		attribute.String("request.id", id), attribute.String("proxy.target", state.target))
 
 	token, err := p.tokenSource.Token()
 	if err != nil {
-		return r, goproxy.NewResponse(r,
-			goproxy.ContentTypeText, http.StatusInternalServerError,
+		return r, errorResponse(ctx, r, http.StatusInternalServerError, stepObtainToken,
 			fmt.Sprintf("failed to obtain IAP token, %s", err))
 	}
+	metrics.TokenExpiry.Set(float64(token.Expiry.Unix()))
+
+	replayable, err := bufferBody(r, p.ReplayBodyLimit)
+	if err != nil {
+		return r, errorResponse(ctx, r, http.StatusBadRequest, stepReadRequest,
+			fmt.Sprintf("failed to read request body, %s", err))
+	}
 
 	removeProxyHeaders(ctx, r)
-	authorization := fmt.Sprintf("%s %s", token.Type(), token.AccessToken)
-	r.Header.Set("Proxy-Authorization", authorization)
+	setProxyAuthorization(r, token)
 	RewriteRequestURL(r, p.targetURL)
+	tracing.Inject(r)
+	r = tracing.WithClientTrace(r)
+	ctx.RoundTripper = p.refreshingRoundTripper(token, replayable)
 
 	return r, nil
 }
 
+// OnResponse records the proxied request in the metrics, trace and log
+func (p *Proxy) OnResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	state, ok := ctx.UserData.(*requestState)
+	if !ok || state.observed {
+		return resp
+	}
+	state.observed = true
+
+	code, step := http.StatusInternalServerError, stepForward
+	if resp != nil {
+		code, step = resp.StatusCode, state.step
+	}
+	metrics.ObserveRequest(state.target, code, step, state.start)
+	tracing.EndSpan(state.span, code, step)
+	slog.Info("proxied request", "requestId", state.id, "target", state.target, "step", step,
+		logging.HTTPRequest(ctx.Req, code, time.Since(state.start)))
+	return resp
+}
+
+// targetName returns the name of the cluster or the host pattern the request is proxied for
+func (p *Proxy) targetName(r *http.Request) string {
+	if p.clusterInfo != nil {
+		if info := p.clusterInfo.GetConnectInfoForEndpoint(r.URL.Host); info != nil {
+			return info.Name
+		}
+	}
+	for _, hostName := range p.hostNames {
+		if hostName.MatchString(r.Host) {
+			return hostName.String()
+		}
+	}
+	return r.URL.Hostname()
+}
+
 func (p *Proxy) createProxy() *goproxy.ProxyHttpServer {
 	proxy := goproxy.NewProxyHttpServer()
 	proxy.Verbose = p.Debug
+	proxy.Logger = logging.NewProxyLogger(slog.Default())
 	proxy.KeepHeader = true
+	proxy.NonproxyHandler = http.HandlerFunc(p.serveNonProxyRequest)
 	proxy.OnRequest(p.IsAllowedProxyEndpoint()).HandleConnect(goproxy.AlwaysMitm)
 	proxy.OnRequest(p.IsAllowedProxyEndpoint()).DoFunc(p.OnRequest)
+	proxy.OnResponse().DoFunc(p.OnResponse)
 
-	goproxy.GoproxyCa = *p.certificate
-	tlsConfig := goproxy.TLSConfigFromCA(p.certificate)
+	goproxy.GoproxyCa = *p.certificate.Certificate()
+	tlsConfig := p.leafCache.TLSConfig()
 
 	goproxy.OkConnect = &goproxy.ConnectAction{
 		Action:    goproxy.ConnectAccept,
@@ -234,3 +400,15 @@ func (p *Proxy) createProxy() *goproxy.ProxyHttpServer {
 
 	return proxy
 }
+
+// serveNonProxyRequest serves the CA certificate, and rejects any other request to the proxy itself
+func (p *Proxy) serveNonProxyRequest(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != caCertificatePath {
+		http.Error(w, "This is a proxy server. Does not respond to non-proxy requests.", http.StatusInternalServerError)
+		return
+	}
+
+	chain := p.certificate.Certificate().Certificate
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: chain[len(chain)-1]})
+}
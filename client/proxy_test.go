@@ -0,0 +1,81 @@
+package client
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeCACertificate(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "id-token")
+	if err := os.WriteFile(tokenFile, []byte(newTestIDToken("audience", time.Now().Add(time.Hour))), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	p := Proxy{
+		TargetURL:     "https://iap.example.com",
+		IDTokenFile:   tokenFile,
+		HostNames:     []string{`^backend\.internal$`},
+		LeafKeyType:   "ecdsa-p256",
+		LeafValidity:  30 * time.Minute,
+		LeafCacheSize: 16,
+	}
+	p.EphemeralCertificate = true
+	if err := p.initialize(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := httptest.NewServer(p.createProxy())
+	t.Cleanup(proxy.Close)
+
+	response, err := http.Get(proxy.URL + caCertificatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(response.Body)
+	block, _ := pem.Decode(body)
+	if response.StatusCode != http.StatusOK || block == nil {
+		t.Fatalf("expected the CA certificate, got %d: %s", response.StatusCode, body)
+	}
+	ca, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ca.IsCA {
+		t.Errorf("expected a CA certificate")
+	}
+
+	if response, err = http.Get(proxy.URL + "/"); err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected other requests to the proxy to be rejected, got %d", response.StatusCode)
+	}
+}
+
+func TestInvalidLeafValidity(t *testing.T) {
+	for _, validity := range []time.Duration{0, -time.Hour, 20 * 365 * 24 * time.Hour} {
+		p := Proxy{
+			TargetURL:     "https://iap.example.com",
+			IDTokenFile:   "id-token",
+			HostNames:     []string{`^backend\.internal$`},
+			LeafKeyType:   "ecdsa-p256",
+			LeafValidity:  validity,
+			LeafCacheSize: 16,
+		}
+		p.EphemeralCertificate = true
+		if err := p.initialize(context.Background()); err == nil || !strings.Contains(err.Error(), "leaf-validity") {
+			t.Errorf("expected an invalid leaf-validity %s to be rejected, got %v", validity, err)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// tokenCacheEarlyExpiry is the time before expiry at which a cached token is no longer used
+const tokenCacheEarlyExpiry = 5 * time.Minute
+
+// tokenRetryInterval is the interval at which a new token is requested, while the token source only returns
+// tokens which are about to expire
+const tokenRetryInterval = 30 * time.Second
+
+// tokenCacheKey identifies the ID tokens in the cache
+type tokenCacheKey struct {
+	Principal string   `json:"principal"`
+	Audience  string   `json:"audience"`
+	Delegates []string `json:"delegates,omitempty"`
+}
+
+// tokenCacheEntry is the content of a cache file
+type tokenCacheEntry struct {
+	tokenCacheKey
+	IDToken string    `json:"id_token"`
+	Expiry  time.Time `json:"expiry"`
+}
+
+// tokenCacheDir returns the directory in which the ID tokens are cached
+func tokenCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "simple-iap-proxy", "tokens"), nil
+}
+
+// clearTokenCache removes all cached ID tokens and discovered audiences
+func clearTokenCache() error {
+	dir, err := tokenCacheDir()
+	if err != nil {
+		return fmt.Errorf("failed to determine the token cache directory, %s", err)
+	}
+	if err = os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("failed to clear the token cache, %s", err)
+	}
+	filename, err := audienceCacheFile()
+	if err != nil {
+		return fmt.Errorf("failed to determine the audience cache file, %s", err)
+	}
+	if err = os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to clear the audience cache, %s", err)
+	}
+	return nil
+}
+
+// isFresh returns true if the token is not about to expire
+func isFresh(token *oauth2.Token) bool {
+	return token != nil && (token.Expiry.IsZero() || time.Until(token.Expiry) > tokenCacheEarlyExpiry)
+}
+
+// cachedTokenSource caches the tokens of the token source in memory, and optionally in a file. When a token is
+// invalidated, the token source is recreated, as the token sources of the Google libraries reuse their tokens too.
+type cachedTokenSource struct {
+	create      func() (oauth2.TokenSource, error)
+	file        *tokenFileCache
+	mutex       sync.Mutex
+	tokenSource oauth2.TokenSource
+	token       *oauth2.Token
+	retryAt     time.Time
+}
+
+func newCachedTokenSource(tokenSource oauth2.TokenSource, create func() (oauth2.TokenSource, error), file *tokenFileCache) *cachedTokenSource {
+	return &cachedTokenSource{
+		create:      create,
+		file:        file,
+		tokenSource: tokenSource,
+	}
+}
+
+// Token returns the cached token, or obtains and caches a new one if it is about to expire. While the token
+// source only returns tokens which are about to expire, the last one is used until the next retry.
+func (s *cachedTokenSource) Token() (*oauth2.Token, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if isFresh(s.token) || s.token.Valid() && time.Now().Before(s.retryAt) {
+		return s.token, nil
+	}
+
+	var cached *oauth2.Token
+	if s.file != nil {
+		unlock, err := s.file.lock()
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+		if cached = s.file.read(); isFresh(cached) {
+			s.token = cached
+			return cached, nil
+		}
+	}
+
+	token, err := s.obtain()
+	if err != nil {
+		return nil, err
+	}
+	if !isFresh(token) {
+		s.retryAt = time.Now().Add(tokenRetryInterval)
+	}
+
+	if s.file != nil && (cached == nil || cached.AccessToken != token.AccessToken) {
+		if err = s.file.write(token); err != nil {
+			slog.Warn("failed to cache ID token", "error", err)
+		}
+	}
+	s.token = token
+	return token, nil
+}
+
+// obtain returns a new token of the token source. When the token is about to expire, the token source is
+// recreated once, as the token sources of the Google libraries reuse a token until 10 seconds before it expires.
+func (s *cachedTokenSource) obtain() (*oauth2.Token, error) {
+	var err error
+	recreated := s.tokenSource == nil
+	if recreated {
+		if s.tokenSource, err = s.create(); err != nil {
+			return nil, err
+		}
+	}
+	token, err := s.tokenSource.Token()
+	if err != nil || isFresh(token) || recreated {
+		return token, err
+	}
+
+	if s.tokenSource, err = s.create(); err != nil {
+		return nil, err
+	}
+	return s.tokenSource.Token()
+}
+
+// Invalidate removes the token from the cache, so that the next call obtains a new one
+func (s *cachedTokenSource) Invalidate(token *oauth2.Token) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.token == nil || s.token.AccessToken != token.AccessToken {
+		// already replaced
+		return
+	}
+	s.token = nil
+	s.tokenSource = nil
+
+	if s.file != nil {
+		unlock, err := s.file.lock()
+		if err != nil {
+			slog.Warn("failed to read cached ID token", "error", err)
+			return
+		}
+		defer unlock()
+		if cached := s.file.read(); cached != nil && cached.AccessToken == token.AccessToken {
+			if err = os.Remove(s.file.filename); err != nil {
+				slog.Warn("failed to remove invalidated ID token from cache", "error", err)
+			}
+		}
+	}
+}
+
+// tokenFileCache stores the ID tokens for a key in a file, so that they are reused across client restarts.
+// Concurrent processes serialize on a lock file, so only one of them obtains a new token.
+type tokenFileCache struct {
+	key      tokenCacheKey
+	filename string
+}
+
+func newTokenFileCache(key tokenCacheKey) (*tokenFileCache, error) {
+	dir, err := tokenCacheDir()
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine the token cache directory, %s", err)
+	}
+	if err = os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create the token cache directory, %s", err)
+	}
+
+	content, err := json.Marshal(key)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(content)
+	return &tokenFileCache{
+		key:      key,
+		filename: filepath.Join(dir, hex.EncodeToString(hash[:])+".json"),
+	}, nil
+}
+
+// lock acquires the lock on the cache file, and returns the function to release it
+func (c *tokenFileCache) lock() (func(), error) {
+	unlock, err := acquireFileLock(c.filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock token cache, %s", err)
+	}
+	return unlock, nil
+}
+
+// acquireFileLock acquires the lock file of the file, and returns the function to release it. Concurrent
+// processes updating the file serialize on it.
+func acquireFileLock(filename string) (func(), error) {
+	lock, err := os.OpenFile(filename+".lock", os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err = lockFile(lock); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return func() {
+		unlockFile(lock)
+		lock.Close()
+	}, nil
+}
+
+// read returns the cached token, or nil if there is none
+func (c *tokenFileCache) read() *oauth2.Token {
+	content, err := os.ReadFile(c.filename)
+	if err != nil {
+		return nil
+	}
+	var entry tokenCacheEntry
+	if err = json.Unmarshal(content, &entry); err != nil {
+		return nil
+	}
+	if entry.Principal != c.key.Principal || entry.Audience != c.key.Audience ||
+		strings.Join(entry.Delegates, ",") != strings.Join(c.key.Delegates, ",") {
+		return nil
+	}
+	return &oauth2.Token{AccessToken: entry.IDToken, TokenType: "Bearer", Expiry: entry.Expiry}
+}
+
+// write stores the token in the cache file, replacing it atomically
+func (c *tokenFileCache) write(token *oauth2.Token) error {
+	content, err := json.Marshal(tokenCacheEntry{
+		tokenCacheKey: c.key,
+		IDToken:       token.AccessToken,
+		Expiry:        token.Expiry,
+	})
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(c.filename), filepath.Base(c.filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), c.filename)
+}
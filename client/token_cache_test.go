@@ -0,0 +1,145 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// isolateTokenCache points the user cache directory to a temporary directory, so that the test neither reads
+// nor writes the cached ID tokens and audiences of the user
+func isolateTokenCache(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("LocalAppData", t.TempDir())
+}
+
+// countingTokenSource returns a new ID token on every call, valid for an hour unless specified otherwise
+type countingTokenSource struct {
+	calls    int
+	validity time.Duration
+}
+
+func (s *countingTokenSource) Token() (*oauth2.Token, error) {
+	s.calls++
+	validity := s.validity
+	if validity == 0 {
+		validity = time.Hour
+	}
+	return tokenFromIDToken(newTestIDToken("audience", time.Now().Add(validity+time.Duration(s.calls)*time.Second)))
+}
+
+func TestFileCachedTokenSource(t *testing.T) {
+	isolateTokenCache(t)
+
+	source := &countingTokenSource{}
+	newSource := func(key tokenCacheKey) *cachedTokenSource {
+		file, err := newTokenFileCache(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return newCachedTokenSource(source, func() (oauth2.TokenSource, error) { return source, nil }, file)
+	}
+	key := tokenCacheKey{Principal: testServiceAccount, Audience: "audience"}
+
+	first := newSource(key)
+	token, err := first.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a restarted client reads the token from the cache
+	second := newSource(key)
+	cached, err := second.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source.calls != 1 || cached.AccessToken != token.AccessToken {
+		t.Fatalf("expected the cached token, got a new token after %d calls", source.calls)
+	}
+
+	dir, _ := tokenCacheDir()
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) != 1 {
+		t.Fatalf("expected 1 cache file, found %d", len(files))
+	}
+	if info, _ := os.Stat(files[0]); info.Mode().Perm() != 0o600 && os.PathSeparator == '/' {
+		t.Errorf("expected cache file mode 0600, got %s", info.Mode().Perm())
+	}
+
+	// a different delegation chain does not share the token
+	other := newSource(tokenCacheKey{Principal: testServiceAccount, Audience: "audience", Delegates: []string{"hop@my-project.iam.gserviceaccount.com"}})
+	if _, err = other.Token(); err != nil {
+		t.Fatal(err)
+	}
+	if source.calls != 2 {
+		t.Fatalf("expected a new token for a different delegation chain, got %d calls", source.calls)
+	}
+
+	// an invalidated token is removed from the cache
+	second.Invalidate(cached)
+	if token, err = second.Token(); err != nil {
+		t.Fatal(err)
+	}
+	if source.calls != 3 || token.AccessToken == cached.AccessToken {
+		t.Fatalf("expected a new token after invalidation, got %d calls", source.calls)
+	}
+
+	if err = clearTokenCache(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = newSource(key).Token(); err != nil {
+		t.Fatal(err)
+	}
+	if source.calls != 4 {
+		t.Fatalf("expected a new token after clearing the cache, got %d calls", source.calls)
+	}
+}
+
+func TestCachedTokenSourceRenewsReusedToken(t *testing.T) {
+	isolateTokenCache(t)
+
+	file, err := newTokenFileCache(tokenCacheKey{Principal: testServiceAccount, Audience: "audience"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the reused token is about to expire, but is returned by the token source until 10 seconds before expiry
+	source := &countingTokenSource{}
+	expiring, err := tokenFromIDToken(newTestIDToken("audience", time.Now().Add(tokenCacheEarlyExpiry/2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	create := func() (oauth2.TokenSource, error) { return oauth2.ReuseTokenSource(nil, source), nil }
+	s := newCachedTokenSource(oauth2.ReuseTokenSource(expiring, source), create, file)
+
+	token, err := s.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source.calls != 1 || !isFresh(token) {
+		t.Fatalf("expected a fresh token from the recreated token source, got %d calls", source.calls)
+	}
+
+	// a token source which only returns tokens about to expire is retried after an interval
+	source.validity = tokenCacheEarlyExpiry / 2
+	s = newCachedTokenSource(oauth2.ReuseTokenSource(nil, source), create, nil)
+	for i := 0; i < 5; i++ {
+		if _, err = s.Token(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if source.calls != 3 {
+		t.Fatalf("expected a token from the token source and from the recreated one until the retry, got %d calls", source.calls-1)
+	}
+	s.retryAt = time.Now()
+	if _, err = s.Token(); err != nil {
+		t.Fatal(err)
+	}
+	if source.calls != 4 {
+		t.Fatalf("expected a new token after the retry interval, got %d calls", source.calls-3)
+	}
+}
@@ -0,0 +1,101 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// tokenExpiryWarning is the remaining lifetime of the ID token below which a warning is given
+const tokenExpiryWarning = 5 * time.Minute
+
+// TokenCommand prints the IAP ID token of the client
+type TokenCommand struct {
+	Proxy
+	ClearCache bool
+	Decode     bool
+}
+
+// NewTokenCmd creates a token command
+func NewTokenCmd() *cobra.Command {
+	c := TokenCommand{}
+	c.Command = cobra.Command{
+		Use:   "token",
+		Short: "prints the IAP ID token of the client",
+		Long: `
+Obtains the ID token exactly as the client does, and prints it. With --decode, the header and
+claims of the token are shown instead, and a warning is given when the audience does not match
+the --iap-audience or the token is about to expire.
+
+The client caches the ID tokens on disk, so they are reused across restarts until shortly
+before they expire. Use --clear-cache to remove all cached ID tokens and discovered audiences.
+`,
+	}
+	c.addTokenFlags(c.Flags())
+	c.Flags().StringVarP(&c.ProjectID, "project", "p", "", "google project id to use")
+	c.Flags().BoolVarP(&c.Decode, "decode", "", false, "show the header and claims of the token")
+	c.Flags().BoolVarP(&c.ClearCache, "clear-cache", "", false, "remove all cached ID tokens and discovered audiences")
+	c.Flags().SortFlags = false
+
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		return c.Run()
+	}
+	return &c.Command
+}
+
+// Run prints the ID token, or clears the token cache
+func (c *TokenCommand) Run() error {
+	if c.ClearCache {
+		return clearTokenCache()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := c.initializeTokenSource(ctx); err != nil {
+		return err
+	}
+	token, err := c.tokenSource.Token()
+	if err != nil {
+		return fmt.Errorf("failed to obtain an ID token for audience %s, %s", c.Audience, err)
+	}
+
+	if !c.Decode {
+		fmt.Println(token.AccessToken)
+		return nil
+	}
+	return c.printDecoded(os.Stdout, token.AccessToken)
+}
+
+// printDecoded writes the header and claims of the ID token, and warns about a mismatching audience or expiry
+func (c *TokenCommand) printDecoded(w io.Writer, idToken string) error {
+	header, claims, err := decodeJWT(idToken)
+	if err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(map[string]interface{}{"header": header, "claims": claims}, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, string(content))
+
+	parsed, err := parseIDTokenClaims(idToken)
+	if err != nil {
+		return err
+	}
+	if c.Audience != "" && parsed.Audience != c.Audience {
+		slog.Warn("the token audience does not match the --iap-audience", "audience", parsed.Audience, "iap_audience", c.Audience)
+	}
+	if remaining := time.Until(parsed.Expiry()); remaining <= 0 {
+		slog.Warn("the token expired", "expiry", parsed.Expiry().Format(time.RFC3339))
+	} else if remaining < tokenExpiryWarning {
+		slog.Warn("the token expires soon", "remaining", remaining.Round(time.Second).String(), "expiry", parsed.Expiry().Format(time.RFC3339))
+	}
+	return nil
+}
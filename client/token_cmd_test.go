@@ -0,0 +1,37 @@
+package client
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"strings"
+	"testing"
+)
+
+func TestTokenCmdProjectFlag(t *testing.T) {
+	isolateTokenCache(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentialsFile := writeJSON(t, "key.json", map[string]interface{}{
+		"type":           "service_account",
+		"project_id":     "my-project",
+		"private_key_id": "1",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+		"client_email":   testServiceAccount,
+		"token_uri":      "https://oauth2.invalid/token",
+	})
+
+	// the target cannot be resolved, so that the audience discovery reports the project it looked in
+	command := NewTokenCmd()
+	command.SetArgs([]string{"--credentials-file", credentialsFile, "--iap-audience", audienceAuto,
+		"--target-url", "https://iap.invalid", "--project", "other-project"})
+	command.SilenceUsage, command.SilenceErrors = true, true
+	err = command.Execute()
+	if err == nil || !strings.Contains(err.Error(), "backend services of project other-project") {
+		t.Errorf("expected the audience to be discovered in the project of --project, got %v", err)
+	}
+}
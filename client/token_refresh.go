@@ -0,0 +1,169 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/binxio/simple-iap-proxy/metrics"
+	"github.com/binxio/simple-iap-proxy/proxyerror"
+	"github.com/binxio/simple-iap-proxy/requestid"
+	"github.com/elazarl/goproxy"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/oauth2"
+)
+
+// the steps of the client reported in the error responses and metrics
+const (
+	stepObtainToken       = "obtain-token"
+	stepReadRequest       = "read-request"
+	stepRefreshToken      = "refresh-token"
+	stepIAPAuthentication = "iap-authentication"
+	stepForward           = "forward"
+)
+
+// recentTokenAge is the age below which an ID token rejected by IAP is not replaced, as a new token is rejected
+// as well when the rejection is persistent, for instance for a missing roles/iap.httpsResourceAccessor
+const recentTokenAge = 30 * time.Second
+
+// requestState tracks a proxied request to report it in the metrics, trace and log
+type requestState struct {
+	id       string
+	start    time.Time
+	target   string
+	step     string
+	observed bool
+	span     trace.Span
+}
+
+// errorResponse returns the error response for the request, and records the step which failed
+func errorResponse(ctx *goproxy.ProxyCtx, r *http.Request, code int, step, message string) *http.Response {
+	if state, ok := ctx.UserData.(*requestState); ok {
+		state.step = step
+	}
+	return proxyerror.NewResponse(r, code, step, message)
+}
+
+// forwardError returns the error response for a request which could not be forwarded via IAP
+func forwardError(ctx *goproxy.ProxyCtx, r *http.Request, err error) *http.Response {
+	return errorResponse(ctx, r, http.StatusBadGateway, stepForward,
+		fmt.Sprintf("failed to forward the request to %s, %s", r.URL.Host, err))
+}
+
+// isIAPRejection returns true if the response is generated by IAP, rejecting the request
+func isIAPRejection(resp *http.Response) bool {
+	return (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) &&
+		resp.Header.Get("X-Goog-IAP-Generated-Response") == "true"
+}
+
+// isRecentToken returns true if the ID token was issued less than the recentTokenAge ago
+func isRecentToken(token *oauth2.Token) bool {
+	claims, err := parseIDTokenClaims(token.AccessToken)
+	return err == nil && claims.IssuedAt != 0 && time.Since(time.Unix(claims.IssuedAt, 0)) < recentTokenAge
+}
+
+// setProxyAuthorization sets the ID token as the proxy authorization of the request
+func setProxyAuthorization(r *http.Request, token *oauth2.Token) {
+	r.Header.Set("Proxy-Authorization", fmt.Sprintf("%s %s", token.Type(), token.AccessToken))
+}
+
+// bufferBody reads the request body of at most limit bytes into memory, so that the request can be replayed.
+// Returns false if the body is too large, in which case it is passed on as is.
+func bufferBody(r *http.Request, limit int64) (bool, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return true, nil
+	}
+	if r.ContentLength > limit {
+		return false, nil
+	}
+
+	content, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return false, err
+	}
+	if int64(len(content)) > limit {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(content), r.Body), r.Body}
+		return false, nil
+	}
+
+	r.Body.Close()
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(content)), nil
+	}
+	r.Body, _ = r.GetBody()
+	return true, nil
+}
+
+// refreshingRoundTripper sends the request via IAP. When IAP rejects the ID token, the token is invalidated
+// and the request is replayed once with a new token, unless the rejected token is recent itself. If that is
+// not possible, a concise error is returned instead of the IAP error page, and a discovered audience is
+// removed from the cache. A failure to forward the request is returned as an error response as well, as
+// goproxy does not pass transport errors of intercepted requests to the response handlers.
+func (p *Proxy) refreshingRoundTripper(token *oauth2.Token, replayable bool) goproxy.RoundTripperFunc {
+	return func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+		resp, err := ctx.Proxy.Tr.RoundTrip(r)
+		if err != nil {
+			return forwardError(ctx, r, err), nil
+		}
+		if !isIAPRejection(resp) {
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		if isRecentToken(token) {
+			return p.rejectedNewToken(ctx, r, resp), nil
+		}
+		p.tokenSource.Invalidate(token)
+		if !replayable {
+			return errorResponse(ctx, r, resp.StatusCode, stepIAPAuthentication,
+				fmt.Sprintf("IAP rejected the ID token with status %d, and the request body is too large to replay", resp.StatusCode)), nil
+		}
+
+		slog.Info("IAP rejected the ID token, replaying the request with a new token",
+			"requestId", requestid.Get(r), "status", resp.StatusCode)
+		token, err := p.tokenSource.Token()
+		metrics.TokenRefreshes.WithLabelValues(metrics.Result(err)).Inc()
+		if err != nil {
+			return errorResponse(ctx, r, http.StatusBadGateway, stepRefreshToken,
+				fmt.Sprintf("failed to obtain a new ID token after IAP rejected the token, %s", err)), nil
+		}
+
+		replay := r.Clone(r.Context())
+		if r.GetBody != nil {
+			if replay.Body, err = r.GetBody(); err != nil {
+				return errorResponse(ctx, r, http.StatusBadGateway, stepReadRequest,
+					fmt.Sprintf("failed to replay the request body, %s", err)), nil
+			}
+		}
+		setProxyAuthorization(replay, token)
+
+		resp, err = ctx.Proxy.Tr.RoundTrip(replay)
+		if err != nil {
+			return forwardError(ctx, r, err), nil
+		}
+		if !isIAPRejection(resp) {
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		return p.rejectedNewToken(ctx, r, resp), nil
+	}
+}
+
+// rejectedNewToken returns the error response for a new ID token rejected by IAP. As the audience may be
+// wrong, a discovered audience is removed from the cache.
+func (p *Proxy) rejectedNewToken(ctx *goproxy.ProxyCtx, r *http.Request, resp *http.Response) *http.Response {
+	if p.audienceDiscovered {
+		if err := clearAudience(p.TargetURL); err != nil {
+			slog.Warn("failed to clear the cached IAP audience", "requestId", requestid.Get(r), "error", err)
+		}
+	}
+	return errorResponse(ctx, r, resp.StatusCode, stepIAPAuthentication,
+		fmt.Sprintf("IAP rejected a new ID token for audience %s with status %d", p.Audience, resp.StatusCode))
+}
@@ -0,0 +1,243 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/binxio/simple-iap-proxy/metrics"
+	"github.com/binxio/simple-iap-proxy/proxyerror"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestReplayAfterIAPRejection(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test requires a shell")
+	}
+
+	// every execution of the command prints a new token, the first of which is revoked
+	dir := t.TempDir()
+	for i := 1; i <= 5; i++ {
+		token := newTestIDToken(fmt.Sprintf("audience-%d", i), time.Now().Add(time.Hour))
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("token-%d", i)), []byte(token), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	revoked, _ := os.ReadFile(filepath.Join(dir, "token-1"))
+	command := fmt.Sprintf("cd %s && echo >> count && cat token-$(wc -c < count | tr -d ' ')", dir)
+
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get("Proxy-Authorization") == "Bearer "+string(revoked) || r.URL.Path != "/" {
+			w.Header().Set("X-Goog-IAP-Generated-Response", "true")
+			http.Error(w, "<html>Invalid IAP credentials</html>", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, "%s", body)
+	}))
+	t.Cleanup(target.Close)
+
+	p := Proxy{
+		TargetURL:       target.URL,
+		IDTokenCommand:  command,
+		HostNames:       []string{`^backend\.internal$`},
+		ReplayBodyLimit: 16,
+		LeafKeyType:     "ecdsa-p256",
+		LeafValidity:    30 * time.Minute,
+		LeafCacheSize:   16,
+	}
+	p.KeyFile, p.CertificateFile = writeTestCertificate(t)
+	if err := p.initialize(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the audience is treated as discovered, so that the cached audience is cleared when IAP rejects the token
+	isolateTokenCache(t)
+	if err := storeAudience(target.URL, testClientID); err != nil {
+		t.Fatal(err)
+	}
+	p.audienceDiscovered = true
+
+	proxy := httptest.NewServer(p.createProxy())
+	t.Cleanup(proxy.Close)
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	hostPattern := `^backend\.internal$`
+	succeeded := testutil.ToFloat64(metrics.Requests.WithLabelValues(hostPattern, "200", ""))
+	rejected := testutil.ToFloat64(metrics.Requests.WithLabelValues(hostPattern, "401", stepIAPAuthentication))
+
+	post := func(path, body string) (int, string) {
+		response, err := client.Post("http://backend.internal"+path, "text/plain", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		content, _ := io.ReadAll(response.Body)
+		return response.StatusCode, string(content)
+	}
+
+	if status, body := post("/", "replayed body"); status != http.StatusOK || body != "replayed body" {
+		t.Fatalf("expected the request to be replayed with a new token, got %d %s", status, body)
+	}
+	if cachedAudience(target.URL) != testClientID {
+		t.Fatalf("expected the cached audience to be kept when the replay succeeds")
+	}
+
+	status, body := post("/always-rejected", "small")
+	var proxyErr proxyerror.Error
+	if err := json.Unmarshal([]byte(body), &proxyErr); err != nil {
+		t.Fatalf("expected a JSON error, got %s", body)
+	}
+	if status != http.StatusUnauthorized || proxyErr.Error.Step != stepIAPAuthentication || proxyErr.Error.RequestID == "" {
+		t.Fatalf("expected an iap-authentication error with a request ID, got %d %s", status, body)
+	}
+	if audience := cachedAudience(target.URL); audience != "" {
+		t.Errorf("expected the cached audience to be cleared when IAP rejects a new token, got %s", audience)
+	}
+
+	status, body = post("/api/v1/namespaces", "small")
+	var kubernetesStatus proxyerror.Status
+	if err := json.Unmarshal([]byte(body), &kubernetesStatus); err != nil {
+		t.Fatalf("expected a JSON status, got %s", body)
+	}
+	if status != http.StatusUnauthorized || kubernetesStatus.Kind != "Status" || kubernetesStatus.Reason != "Unauthorized" {
+		t.Fatalf("expected a Kubernetes Status for an API call, got %d %s", status, body)
+	}
+
+	status, body = post("/always-rejected", "a body which is too large to replay")
+	if err := json.Unmarshal([]byte(body), &proxyErr); err != nil || !strings.Contains(proxyErr.Error.Message, "too large") {
+		t.Fatalf("expected an error for a body too large to replay, got %d %s", status, body)
+	}
+
+	if count := testutil.ToFloat64(metrics.Requests.WithLabelValues(hostPattern, "200", "")) - succeeded; count != 1 {
+		t.Errorf("expected 1 successful request in the metrics, got %v", count)
+	}
+	if count := testutil.ToFloat64(metrics.Requests.WithLabelValues(hostPattern, "401", stepIAPAuthentication)) - rejected; count != 3 {
+		t.Errorf("expected 3 requests failing on iap-authentication in the metrics, got %v", count)
+	}
+}
+
+func TestForwardErrorOnRefusedConnection(t *testing.T) {
+	// reserve a port, and close it so that connections are refused
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := "https://" + listener.Addr().String()
+	listener.Close()
+
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	if err = os.WriteFile(tokenFile, []byte(newTestIDToken("audience", time.Now().Add(time.Hour))), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	p := Proxy{
+		TargetURL:     target,
+		IDTokenFile:   tokenFile,
+		HostNames:     []string{`^refused\.internal(:443)?$`},
+		LeafKeyType:   "ecdsa-p256",
+		LeafValidity:  30 * time.Minute,
+		LeafCacheSize: 16,
+	}
+	p.KeyFile, p.CertificateFile = writeTestCertificate(t)
+	if err = p.initialize(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := httptest.NewServer(p.createProxy())
+	t.Cleanup(proxy.Close)
+	proxyURL, _ := url.Parse(proxy.URL)
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(p.certificate.Certificate().Leaf)
+	client := http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: rootCAs},
+	}}
+
+	hostPattern := `^refused\.internal(:443)?$`
+	failed := testutil.ToFloat64(metrics.Requests.WithLabelValues(hostPattern, "502", stepForward))
+
+	// intercepted request, on which goproxy does not call the response handlers for transport errors
+	response, err := client.Get("https://refused.internal/api/v1/pods")
+	if err != nil {
+		t.Fatalf("expected an error response instead of a dropped connection, got %s", err)
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(response.Body)
+
+	var kubernetesStatus proxyerror.Status
+	if err = json.Unmarshal(body, &kubernetesStatus); err != nil {
+		t.Fatalf("expected a JSON status, got %s", body)
+	}
+	if response.StatusCode != http.StatusBadGateway || kubernetesStatus.Reason != "ServiceUnavailable" ||
+		!strings.Contains(kubernetesStatus.Message, "failed to forward") {
+		t.Errorf("expected a bad gateway status on the forward step, got %d %s", response.StatusCode, body)
+	}
+	if count := testutil.ToFloat64(metrics.Requests.WithLabelValues(hostPattern, "502", stepForward)) - failed; count != 1 {
+		t.Errorf("expected 1 request failing on forward in the metrics, got %v", count)
+	}
+}
+
+func TestNoReplayWithRecentToken(t *testing.T) {
+	var requests atomic.Int32
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("X-Goog-IAP-Generated-Response", "true")
+		http.Error(w, "<html>You don't have access</html>", http.StatusForbidden)
+	}))
+	t.Cleanup(target.Close)
+
+	// a token issued just now, which IAP rejects as the caller lacks access
+	claims := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"aud":"audience","iat":%d,"exp":%d}`,
+		time.Now().Unix(), time.Now().Add(time.Hour).Unix())))
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("eyJhbGciOiJSUzI1NiJ9."+claims+".c2lnbmF0dXJl"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	p := Proxy{
+		TargetURL:       target.URL,
+		IDTokenFile:     tokenFile,
+		HostNames:       []string{`^backend\.internal$`},
+		ReplayBodyLimit: 16,
+		LeafKeyType:     "ecdsa-p256",
+		LeafValidity:    30 * time.Minute,
+		LeafCacheSize:   16,
+	}
+	p.KeyFile, p.CertificateFile = writeTestCertificate(t)
+	if err := p.initialize(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := httptest.NewServer(p.createProxy())
+	t.Cleanup(proxy.Close)
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	response, err := client.Get("http://backend.internal/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusForbidden || requests.Load() != 1 {
+		t.Errorf("expected the rejection of the recent token without a replay, got %d after %d requests",
+			response.StatusCode, requests.Load())
+	}
+}
@@ -0,0 +1,218 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iamcredentials/v1"
+	"google.golang.org/api/idtoken"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+)
+
+// idTokenSource provides the IAP ID tokens. A token rejected by IAP is invalidated, so that a new one is obtained.
+type idTokenSource interface {
+	oauth2.TokenSource
+	Invalidate(token *oauth2.Token)
+}
+
+// createTokenSource creates the source of the IAP ID tokens. A provided ID token file or command bypasses the
+// credentials altogether. If a service account is specified, the token is obtained by impersonating it.
+// Otherwise the ID token is minted for the credentials itself, which is only possible for service account
+// keys and the metadata server on GCE and Cloud Build. External accounts impersonate the service account
+// from their configuration.
+func (p *Proxy) createTokenSource(ctx context.Context) (idTokenSource, error) {
+	switch {
+	case p.IDTokenFile != "":
+		return newFileTokenSource(p.IDTokenFile), nil
+	case p.IDTokenCommand != "":
+		return newCommandTokenSource(p.IDTokenCommand), nil
+	}
+
+	create := func() (oauth2.TokenSource, error) {
+		return p.createCredentialsTokenSource(ctx)
+	}
+	tokenSource, err := create()
+	if err != nil {
+		return nil, err
+	}
+
+	var file *tokenFileCache
+	if !p.NoTokenCache {
+		file, err = newTokenFileCache(tokenCacheKey{
+			Principal: p.tokenPrincipal(),
+			Audience:  p.Audience,
+			Delegates: p.Delegates,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return newCachedTokenSource(tokenSource, create, file), nil
+}
+
+// createCredentialsTokenSource creates the source of the ID tokens obtained with the credentials
+func (p *Proxy) createCredentialsTokenSource(ctx context.Context) (oauth2.TokenSource, error) {
+	if p.ServiceAccount != "" && len(p.Delegates) > 0 {
+		service, err := iamcredentials.NewService(ctx, option.WithTokenSource(p.impersonationCredentials.TokenSource))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create the IAM credentials service, %s", err)
+		}
+		return &delegationChainTokenSource{
+			ctx:      ctx,
+			service:  service,
+			audience: p.Audience,
+			chain:    append(append([]string{}, p.Delegates...), p.ServiceAccount),
+		}, nil
+	}
+
+	if p.ServiceAccount != "" {
+		tokenConfig := impersonate.IDTokenConfig{
+			TargetPrincipal: p.ServiceAccount,
+			Audience:        p.Audience,
+			IncludeEmail:    true,
+		}
+
+		tokenSource, err := impersonate.IDTokenSource(
+			ctx,
+			tokenConfig,
+			option.WithTokenSource(p.impersonationCredentials.TokenSource),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create a token source for %s with audience %s, %s",
+				p.ServiceAccount, p.Audience, err)
+		}
+		return tokenSource, nil
+	}
+
+	if len(p.Delegates) > 0 {
+		return nil, fmt.Errorf("--delegate requires a --service-account to impersonate")
+	}
+
+	switch credentialsType(p.credentials.JSON) {
+	case "service_account":
+		break
+	case "":
+		if !p.metadataCredentials {
+			return nil, fmt.Errorf("user credentials cannot obtain an ID token for audience %s, specify a --service-account to impersonate", p.Audience)
+		}
+	default:
+		return nil, fmt.Errorf("%s credentials cannot obtain an ID token for audience %s, specify a --service-account to impersonate",
+			credentialsType(p.credentials.JSON), p.Audience)
+	}
+
+	tokenSource, err := idtoken.NewTokenSource(ctx, p.Audience, option.WithCredentials(p.credentials))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a token source with audience %s, %s", p.Audience, err)
+	}
+	return tokenSource, nil
+}
+
+// delegationChainTokenSource obtains the ID token of the last service account in the delegation chain with the
+// IAM credentials API. When the ID token is denied, it reports which hop in the chain was denied. The hops are
+// checked by obtaining an ID token for each intermediate service account, which requires the same
+// roles/iam.serviceAccountTokenCreator as the delegation itself.
+type delegationChainTokenSource struct {
+	ctx      context.Context
+	service  *iamcredentials.Service
+	audience string
+	chain    []string
+}
+
+// Token returns the ID token of the last service account in the chain
+func (s *delegationChainTokenSource) Token() (*oauth2.Token, error) {
+	token, err := s.idToken(len(s.chain) - 1)
+	if isPermissionDenied(err) {
+		return nil, s.deniedHop(err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to obtain an ID token for %s with audience %s, %s", s.chain[len(s.chain)-1], s.audience, err)
+	}
+	return token, nil
+}
+
+// idToken obtains an ID token for the service account at position i in the chain, via the preceding hops
+func (s *delegationChainTokenSource) idToken(i int) (*oauth2.Token, error) {
+	delegates := make([]string, 0, i)
+	for _, delegate := range s.chain[:i] {
+		delegates = append(delegates, "projects/-/serviceAccounts/"+delegate)
+	}
+	response, err := s.service.Projects.ServiceAccounts.GenerateIdToken(
+		"projects/-/serviceAccounts/"+s.chain[i],
+		&iamcredentials.GenerateIdTokenRequest{
+			Audience:     s.audience,
+			Delegates:    delegates,
+			IncludeEmail: true,
+		}).Context(s.ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	claims, err := parseIDTokenClaims(response.Token)
+	if err != nil {
+		return nil, err
+	}
+	return &oauth2.Token{AccessToken: response.Token, Expiry: claims.Expiry()}, nil
+}
+
+// deniedHop returns an error naming the first hop in the delegation chain which was denied
+func (s *delegationChainTokenSource) deniedHop(err error) error {
+	hop := len(s.chain) - 1
+	for i := 0; i < len(s.chain)-1; i++ {
+		if _, hopErr := s.idToken(i); isPermissionDenied(hopErr) {
+			hop, err = i, hopErr
+			break
+		}
+	}
+
+	caller := "the caller"
+	if hop > 0 {
+		caller = s.chain[hop-1]
+	}
+	return fmt.Errorf("hop %d of the delegation chain from %s to %s was denied, %s", hop+1, caller, s.chain[hop], err)
+}
+
+// isPermissionDenied returns true if the error is a 403 of a Google API or of the token endpoint of the credentials
+func isPermissionDenied(err error) bool {
+	var apiErr *googleapi.Error
+	var retrieveErr *oauth2.RetrieveError
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusForbidden ||
+		errors.As(err, &retrieveErr) && retrieveErr.Response != nil && retrieveErr.Response.StatusCode == http.StatusForbidden
+}
+
+// tokenPrincipal returns the principal for which the ID tokens are obtained
+func (p *Proxy) tokenPrincipal() string {
+	if p.ServiceAccount != "" {
+		return p.ServiceAccount
+	}
+	if email := credentialsClientEmail(p.credentials.JSON); email != "" {
+		return email
+	}
+	return "metadata"
+}
+
+// credentialsType returns the type of the JSON credentials, or an empty string if unknown
+func credentialsType(credentialsJSON []byte) string {
+	var f struct {
+		Type string `json:"type"`
+	}
+	if len(credentialsJSON) == 0 || json.Unmarshal(credentialsJSON, &f) != nil {
+		return ""
+	}
+	return f.Type
+}
+
+// credentialsClientEmail returns the email of the service account key, or an empty string if unknown
+func credentialsClientEmail(credentialsJSON []byte) string {
+	var f struct {
+		ClientEmail string `json:"client_email"`
+	}
+	if len(credentialsJSON) == 0 || json.Unmarshal(credentialsJSON, &f) != nil {
+		return ""
+	}
+	return f.ClientEmail
+}
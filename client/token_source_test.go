@@ -0,0 +1,81 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/iamcredentials/v1"
+	"google.golang.org/api/option"
+)
+
+func TestDelegationChainTokenSource(t *testing.T) {
+	const denied = "denied@my-project.iam.gserviceaccount.com"
+	idToken := newTestIDToken("my-audience", time.Now().Add(time.Hour))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request iamcredentials.GenerateIdTokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if strings.Contains(r.URL.Path, denied) || strings.Contains(strings.Join(request.Delegates, ","), denied) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"error":{"code":403,"message":"Permission 'iam.serviceAccounts.getOpenIdToken' denied","status":"PERMISSION_DENIED"}}`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"token":%q}`, idToken)
+	}))
+	defer server.Close()
+
+	service, err := iamcredentials.NewService(context.Background(), option.WithEndpoint(server.URL), option.WithHTTPClient(server.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &delegationChainTokenSource{ctx: context.Background(), service: service, audience: "my-audience",
+		chain: []string{"first@my-project.iam.gserviceaccount.com", testServiceAccount}}
+	token, err := s.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != idToken || token.Expiry.Before(time.Now()) {
+		t.Errorf("expected the ID token with its expiry, got %v", token)
+	}
+
+	s.chain = []string{"first@my-project.iam.gserviceaccount.com", denied, testServiceAccount}
+	_, err = s.Token()
+	if err == nil || !strings.Contains(err.Error(), "hop 2 of the delegation chain from first@my-project.iam.gserviceaccount.com to "+denied) {
+		t.Errorf("expected hop 2 to be reported as denied, got %v", err)
+	}
+}
+
+func TestIsPermissionDenied(t *testing.T) {
+	retrieveErr := &oauth2.RetrieveError{Response: &http.Response{StatusCode: http.StatusForbidden}}
+	if !isPermissionDenied(&url.Error{Op: "Post", URL: "https://sts.googleapis.com/v1/token", Err: retrieveErr}) {
+		t.Errorf("expected a wrapped 403 of the token endpoint to be denied")
+	}
+	if isPermissionDenied(fmt.Errorf("impersonate: status code 403: denied")) {
+		t.Errorf("expected an error without a status to be not denied")
+	}
+}
+
+func TestUserCredentialsWithoutJSON(t *testing.T) {
+	// the credentials of the gcloud configuration have no JSON, like those of the metadata server
+	p := Proxy{
+		Audience:    "my-audience",
+		credentials: &google.Credentials{TokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "user-token"})},
+	}
+	if _, err := p.createCredentialsTokenSource(context.Background()); err == nil || !strings.Contains(err.Error(), "user credentials cannot obtain an ID token") {
+		t.Errorf("expected user credentials not to obtain an ID token via the metadata server, got %v", err)
+	}
+}
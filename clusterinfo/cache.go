@@ -5,7 +5,8 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"strings"
 	"sync"
 	"time"
@@ -18,9 +19,14 @@ import (
 // ConnectInfo provides basie GKE cluster connect information
 type ConnectInfo struct {
 	Name                 string
+	Location             string
 	Endpoint             string
 	ClusterCaCertificate string
 	RootCAs              *x509.CertPool
+
+	// the CA certificate before a rotation, which is accepted until previousCaUntil
+	previousCaCertificate string
+	previousCaUntil       time.Time
 }
 
 // Map provides a lookup for cluster connection information base on the hostname
@@ -33,7 +39,18 @@ type Cache struct {
 	credentials *google.Credentials
 	refresh     time.Duration
 	clusterInfo *Map
+	lastRefresh time.Time
+	lastError   error
 	mutex       sync.Mutex
+
+	subscribers    map[int]func(Event)
+	nextSubscriber int
+
+	refreshMutex     sync.Mutex
+	lastAttempt      time.Time
+	misses           map[string]time.Time
+	trigger          chan struct{}
+	clusterRefreshes map[string]time.Time
 }
 
 // NewCache creates a cluster info cache which is refreshed every `refresh`
@@ -43,12 +60,12 @@ func NewCache(ctx context.Context, projectID string, credentials *google.Credent
 		credentials: credentials,
 		projectID:   projectID,
 		refresh:     refresh,
+		misses:      make(map[string]time.Time),
+		trigger:     make(chan struct{}, 1),
 	}
-	clusterInfo, err := cache.retrieveClusters()
-	if err != nil {
+	if err := cache.Refresh(ctx); err != nil {
 		return nil, err
 	}
-	cache.clusterInfo = clusterInfo
 	go cache.run()
 	return cache, nil
 }
@@ -56,12 +73,55 @@ func NewCache(ctx context.Context, projectID string, credentials *google.Credent
 // GetConnectInfoForEndpoint returns connect information for the host, or nil if not found
 func (c *Cache) GetConnectInfoForEndpoint(endpoint string) *ConnectInfo {
 	host := strings.Split(endpoint, ":")
-	if r, ok := (*c.clusterInfo)[host[0]]; ok {
+	if r, ok := (*c.getClusterInfo())[host[0]]; ok {
 		return r
 	}
 	return nil
 }
 
+// LookupConnectInfo returns connect information for the host. If the host is an IP address which is not found,
+// the cluster information is refreshed on demand to find newly created clusters, unless it was refreshed less than
+// minOnDemandInterval ago or the host was not found recently. Returns nil if not found.
+func (c *Cache) LookupConnectInfo(ctx context.Context, endpoint string) *ConnectInfo {
+	if info := c.GetConnectInfoForEndpoint(endpoint); info != nil {
+		return info
+	}
+
+	host := strings.Split(endpoint, ":")[0]
+	if net.ParseIP(host) == nil || c.recentlyMissed(host) {
+		return nil
+	}
+	if _, err := c.RequestRefresh(ctx); err != nil {
+		slog.Error("failed to refresh cluster information on demand", "endpoint", host, "error", err)
+	}
+	info := c.GetConnectInfoForEndpoint(endpoint)
+	if info == nil {
+		c.addMiss(host)
+	}
+	return info
+}
+
+// GetConnectInfoOrRefresh returns connect information for the host, or nil if not found. If the host is an IP
+// address which is not found, the cluster information is refreshed on demand in the background, so that a
+// retry finds a newly created cluster. Unlike LookupConnectInfo, it never waits for a refresh.
+func (c *Cache) GetConnectInfoOrRefresh(endpoint string) *ConnectInfo {
+	if info := c.GetConnectInfoForEndpoint(endpoint); info != nil {
+		return info
+	}
+
+	host := strings.Split(endpoint, ":")[0]
+	if net.ParseIP(host) == nil || c.recentlyMissed(host) {
+		return nil
+	}
+	c.addMiss(host)
+	go func() {
+		if _, err := c.RequestRefresh(c.ctx); err != nil {
+			slog.Error("failed to refresh cluster information on demand", "endpoint", host, "error", err)
+		}
+	}()
+	return nil
+}
+
 // thread safe get cluster info
 func (c *Cache) getClusterInfo() *Map {
 	c.mutex.Lock()
@@ -69,11 +129,55 @@ func (c *Cache) getClusterInfo() *Map {
 	return c.clusterInfo
 }
 
-// thread safe set cluster info
+// thread safe set cluster info after a refresh of all clusters
 func (c *Cache) setClusterInfo(m *Map) {
+	c.updateClusterInfo(m, true)
+}
+
+// thread safe update of the cluster info, accepting the previous CA of the clusters with a rotated CA, and
+// notifying the subscribers of the changes to the previous cluster info
+func (c *Cache) updateClusterInfo(m *Map, refreshed bool) {
 	c.mutex.Lock()
-	defer c.mutex.Unlock()
+	previous := c.clusterInfo
+	if previous != nil {
+		acceptPreviousCAs(*previous, *m, time.Now())
+	}
 	c.clusterInfo = m
+	if refreshed {
+		c.lastRefresh = time.Now()
+		c.lastError = nil
+	}
+	c.mutex.Unlock()
+
+	if previous != nil {
+		c.notify(diff(*previous, *m))
+	}
+}
+
+// thread safe set the error of the last refresh
+func (c *Cache) setLastError(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.lastError = err
+}
+
+// Size returns the number of clusters in the cache
+func (c *Cache) Size() int {
+	return len(*c.getClusterInfo())
+}
+
+// LastRefresh returns the time of the last successful refresh of the cluster information
+func (c *Cache) LastRefresh() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.lastRefresh
+}
+
+// LastError returns the error of the last refresh, or nil if it succeeded
+func (c *Cache) LastError() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.lastError
 }
 
 // GetMap returns a copy of the cluster info map
@@ -83,69 +187,64 @@ func (c *Cache) GetMap() *Map {
 		result[k] = &ConnectInfo{
 			Endpoint:             v.Endpoint,
 			Name:                 v.Name,
+			Location:             v.Location,
 			ClusterCaCertificate: v.ClusterCaCertificate,
 			RootCAs:              v.RootCAs,
+
+			previousCaCertificate: v.previousCaCertificate,
+			previousCaUntil:       v.previousCaUntil,
 		}
 	}
 	return &result
 }
 
-func (c *Cache) run() {
-	for {
-		select {
-		case <-c.ctx.Done():
-			log.Printf("INFO: cluster info cache shutting down")
-			return
-		case <-time.After(c.refresh):
-			break
-		}
-		if clusterInfo, err := c.retrieveClusters(); err == nil {
-			c.setClusterInfo(clusterInfo)
+// creates a ca cert pool from the clusterCaCertificates
+func createCertPool(name string, clusterCaCertificates ...string) *x509.CertPool {
+	result := x509.NewCertPool()
+	for _, clusterCaCertificate := range clusterCaCertificates {
+		cert, err := base64.StdEncoding.DecodeString(clusterCaCertificate)
+		if err == nil {
+			if ok := result.AppendCertsFromPEM(cert); !ok {
+				slog.Error("failed to add CA certificates of cluster to pool", "cluster", name)
+			}
 		} else {
-			log.Printf("ERROR: failed to refresh cluster information, %s", err)
+			slog.Error("failed to decode CA certificate of cluster", "cluster", name, "error", err)
 		}
 	}
+	return result
 }
 
-// creates a ca cert pool from the clusterCaCertificate
-func createCertPool(name string, clusterCaCertificate string) *x509.CertPool {
-	result := x509.NewCertPool()
-	cert, err := base64.StdEncoding.DecodeString(clusterCaCertificate)
-	if err == nil {
-		if ok := result.AppendCertsFromPEM(cert); !ok {
-			log.Printf("ERROR: failed to add CA certificates of cluster %s to pool", name)
-		}
-	} else {
-		log.Printf("ERROR: failed to decode CA certificate of cluster %s, %s", name, err)
+// newConnectInfo returns the connect information of the cluster
+func newConnectInfo(cluster *container.Cluster) *ConnectInfo {
+	return &ConnectInfo{
+		Name:                 cluster.Name,
+		Location:             cluster.Location,
+		Endpoint:             cluster.Endpoint,
+		ClusterCaCertificate: cluster.MasterAuth.ClusterCaCertificate,
+		RootCAs:              createCertPool(cluster.Name, cluster.MasterAuth.ClusterCaCertificate),
 	}
-	return result
 }
 
-func (c *Cache) retrieveClusters() (*Map, error) {
+func (c *Cache) retrieveClusters(ctx context.Context) (*Map, error) {
 	result := make(Map)
 
-	service, err := container.NewService(c.ctx,
+	service, err := container.NewService(ctx,
 		option.WithTokenSource(c.credentials.TokenSource))
 	if err != nil {
 		return nil, err
 	}
 	parent := fmt.Sprintf("projects/%s/locations/-", c.projectID)
-	response, err := service.Projects.Locations.Clusters.List(parent).Do()
+	response, err := service.Projects.Locations.Clusters.List(parent).Context(ctx).Do()
 	if err != nil {
 		return nil, err
 	}
 	for _, cluster := range response.Clusters {
 		if cluster.Status != "RUNNING" {
-			log.Printf("INFO: skipping cluster %s in status %s", cluster.Name, cluster.Status)
+			slog.Info("skipping cluster", "cluster", cluster.Name, "status", cluster.Status)
 			continue
 		}
-		result[cluster.Endpoint] = &ConnectInfo{
-			Name:                 cluster.Name,
-			Endpoint:             cluster.Endpoint,
-			ClusterCaCertificate: cluster.MasterAuth.ClusterCaCertificate,
-			RootCAs:              createCertPool(cluster.Name, cluster.MasterAuth.ClusterCaCertificate),
-		}
+		result[cluster.Endpoint] = newConnectInfo(cluster)
 	}
-	log.Printf("INFO: refreshed cluster information. Found %d running clusters", len(result))
+	slog.Info("refreshed cluster information", "running_clusters", len(result))
 	return &result, nil
 }
@@ -0,0 +1,124 @@
+package clusterinfo
+
+import (
+	"log/slog"
+	"sort"
+)
+
+// EventType is the type of change of a cluster in the cache
+type EventType string
+
+// the types of changes of a cluster
+const (
+	Added   EventType = "added"
+	Removed EventType = "removed"
+	Changed EventType = "changed"
+)
+
+// the changed properties of a cluster reported in the event
+const (
+	ChangedEndpoint = "endpoint"
+	ChangedCA       = "ca"
+)
+
+// Event reports the change of a cluster on a refresh of the cache
+type Event struct {
+	Type EventType
+	// Cluster is the new connect information, or the removed one
+	Cluster *ConnectInfo
+	// Previous is the connect information before the change, on a change only
+	Previous *ConnectInfo
+	// Changes lists the changed properties, on a change only
+	Changes []string
+}
+
+// Subscribe registers a function which is called with each change of a cluster on a refresh of the cache.
+// The function is called from the refresh loop, and must not block. Returns the function to unsubscribe.
+func (c *Cache) Subscribe(f func(Event)) func() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.subscribers == nil {
+		c.subscribers = make(map[int]func(Event))
+	}
+	id := c.nextSubscriber
+	c.nextSubscriber++
+	c.subscribers[id] = f
+
+	return func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		delete(c.subscribers, id)
+	}
+}
+
+// notify logs the events, and passes them to the subscribers
+func (c *Cache) notify(events []Event) {
+	c.mutex.Lock()
+	subscribers := make([]func(Event), 0, len(c.subscribers))
+	for _, f := range c.subscribers {
+		subscribers = append(subscribers, f)
+	}
+	c.mutex.Unlock()
+
+	for _, event := range events {
+		switch event.Type {
+		case Changed:
+			slog.Info("cluster changed", "cluster", event.Cluster.Name, "location", event.Cluster.Location,
+				"endpoint", event.Cluster.Endpoint, "previous_endpoint", event.Previous.Endpoint, "changes", event.Changes)
+		default:
+			slog.Info("cluster "+string(event.Type), "cluster", event.Cluster.Name, "location", event.Cluster.Location,
+				"endpoint", event.Cluster.Endpoint)
+		}
+		for _, f := range subscribers {
+			f(event)
+		}
+	}
+}
+
+// diff returns the changes of the clusters between the previous and the current map, identifying the clusters
+// by location and name so that a change of the endpoint is reported as a change of the cluster.
+func diff(previous, current Map) []Event {
+	before := byCluster(previous)
+	after := byCluster(current)
+
+	events := make([]Event, 0)
+	for key, info := range after {
+		old, ok := before[key]
+		if !ok {
+			events = append(events, Event{Type: Added, Cluster: info})
+			continue
+		}
+		changes := make([]string, 0)
+		if old.Endpoint != info.Endpoint {
+			changes = append(changes, ChangedEndpoint)
+		}
+		if old.ClusterCaCertificate != info.ClusterCaCertificate {
+			changes = append(changes, ChangedCA)
+		}
+		if len(changes) > 0 {
+			events = append(events, Event{Type: Changed, Cluster: info, Previous: old, Changes: changes})
+		}
+	}
+	for key, info := range before {
+		if _, ok := after[key]; !ok {
+			events = append(events, Event{Type: Removed, Cluster: info})
+		}
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		return clusterKey(events[i].Cluster) < clusterKey(events[j].Cluster)
+	})
+	return events
+}
+
+func byCluster(m Map) map[string]*ConnectInfo {
+	result := make(map[string]*ConnectInfo, len(m))
+	for _, info := range m {
+		result[clusterKey(info)] = info
+	}
+	return result
+}
+
+func clusterKey(info *ConnectInfo) string {
+	return info.Location + "/" + info.Name
+}
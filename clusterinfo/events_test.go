@@ -0,0 +1,54 @@
+package clusterinfo
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSubscribe(t *testing.T) {
+	cache := &Cache{}
+	cache.setClusterInfo(&Map{
+		"10.0.0.1": {Name: "a", Location: "europe-west4", Endpoint: "10.0.0.1", ClusterCaCertificate: "ca-a"},
+		"10.0.0.2": {Name: "b", Location: "europe-west4", Endpoint: "10.0.0.2", ClusterCaCertificate: "ca-b"},
+		"10.0.0.3": {Name: "c", Location: "europe-west4", Endpoint: "10.0.0.3", ClusterCaCertificate: "ca-c"},
+	})
+
+	events := make([]Event, 0)
+	unsubscribe := cache.Subscribe(func(event Event) {
+		events = append(events, event)
+	})
+
+	cache.setClusterInfo(&Map{
+		"10.0.0.1": {Name: "a", Location: "europe-west4", Endpoint: "10.0.0.1", ClusterCaCertificate: "ca-a"},
+		"10.0.0.4": {Name: "b", Location: "europe-west4", Endpoint: "10.0.0.4", ClusterCaCertificate: "ca-b2"},
+		"10.0.0.5": {Name: "d", Location: "us-central1", Endpoint: "10.0.0.5", ClusterCaCertificate: "ca-d"},
+	})
+
+	type summary struct {
+		Type    EventType
+		Name    string
+		Changes []string
+	}
+	got := make([]summary, 0, len(events))
+	for _, event := range events {
+		got = append(got, summary{event.Type, event.Cluster.Name, event.Changes})
+	}
+	expected := []summary{
+		{Changed, "b", []string{ChangedEndpoint, ChangedCA}},
+		{Removed, "c", nil},
+		{Added, "d", nil},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected events %v, got %v", expected, got)
+	}
+	if events[0].Previous == nil || events[0].Previous.Endpoint != "10.0.0.2" {
+		t.Errorf("expected the previous connect information on a change, got %v", events[0].Previous)
+	}
+
+	unsubscribe()
+	events = events[:0]
+	cache.setClusterInfo(&Map{})
+	if len(events) != 0 {
+		t.Errorf("expected no events after unsubscribe, got %v", events)
+	}
+}
@@ -0,0 +1,138 @@
+package clusterinfo
+
+import (
+	"context"
+	"log/slog"
+	"math/rand"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/binxio/simple-iap-proxy/metrics"
+)
+
+const (
+	// initialBackoff is the delay before the first retry of a failed refresh, which doubles on each failure
+	initialBackoff = 5 * time.Second
+	// minOnDemandInterval is the minimum interval between refreshes on demand
+	minOnDemandInterval = 10 * time.Second
+	// missTTL is the time an endpoint which was not found after a refresh is not looked up again
+	missTTL = time.Minute
+)
+
+// Refresh retrieves the cluster information now
+func (c *Cache) Refresh(ctx context.Context) error {
+	c.refreshMutex.Lock()
+	defer c.refreshMutex.Unlock()
+	return c.refreshLocked(ctx)
+}
+
+// RequestRefresh retrieves the cluster information now, unless it was retrieved less than minOnDemandInterval ago.
+// Returns true if the cluster information was retrieved.
+func (c *Cache) RequestRefresh(ctx context.Context) (bool, error) {
+	c.refreshMutex.Lock()
+	defer c.refreshMutex.Unlock()
+	if time.Since(c.lastAttempt) < minOnDemandInterval {
+		return false, nil
+	}
+	return true, c.refreshLocked(ctx)
+}
+
+// TriggerRefresh makes the refresh loop retrieve the cluster information as soon as possible
+func (c *Cache) TriggerRefresh() {
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// RefreshOnSignal triggers a refresh when the process receives one of the signals, until the context is done
+func (c *Cache) RefreshOnSignal(ctx context.Context, signals ...os.Signal) {
+	received := make(chan os.Signal, 1)
+	signal.Notify(received, signals...)
+	defer signal.Stop(received)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case s := <-received:
+			slog.Info("received signal, refreshing cluster information", "signal", s.String())
+			c.TriggerRefresh()
+		}
+	}
+}
+
+func (c *Cache) refreshLocked(ctx context.Context) error {
+	c.lastAttempt = time.Now()
+	clusterInfo, err := c.retrieveClusters(ctx)
+	metrics.ClusterCacheRefreshes.WithLabelValues(metrics.Result(err)).Inc()
+	if err != nil {
+		c.setLastError(err)
+		return err
+	}
+	c.setClusterInfo(clusterInfo)
+	return nil
+}
+
+// run refreshes the cluster information every refresh interval, or when triggered. After a failure, the refresh
+// is retried with exponential backoff and jitter.
+func (c *Cache) run() {
+	failures := 0
+	for {
+		wait := c.refresh
+		if failures > 0 {
+			wait = backoff(failures, c.refresh)
+		}
+
+		select {
+		case <-c.ctx.Done():
+			slog.Info("cluster info cache shutting down")
+			return
+		case <-time.After(wait):
+		case <-c.trigger:
+		}
+
+		if err := c.Refresh(c.ctx); err != nil {
+			failures++
+			slog.Error("failed to refresh cluster information", "error", err, "failures", failures)
+			continue
+		}
+		failures = 0
+	}
+}
+
+// backoff returns the delay before the retry after the number of failures, doubling from initialBackoff up to
+// maximum, with a random jitter of up to half the delay to spread the retries of multiple instances
+func backoff(failures int, maximum time.Duration) time.Duration {
+	delay := maximum
+	if failures < 32 {
+		delay = min(initialBackoff<<(failures-1), maximum)
+	}
+	half := int64(delay / 2)
+	if half <= 0 {
+		return delay
+	}
+	return time.Duration(half + rand.Int63n(half))
+}
+
+func (c *Cache) recentlyMissed(host string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	missed, ok := c.misses[host]
+	return ok && time.Since(missed) < missTTL
+}
+
+func (c *Cache) addMiss(host string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.misses == nil {
+		c.misses = make(map[string]time.Time)
+	}
+	for h, missed := range c.misses {
+		if time.Since(missed) >= missTTL {
+			delete(c.misses, h)
+		}
+	}
+	c.misses[host] = time.Now()
+}
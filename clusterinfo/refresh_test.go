@@ -0,0 +1,55 @@
+package clusterinfo
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	for failures, expected := range map[int]time.Duration{
+		1:  initialBackoff,
+		2:  2 * initialBackoff,
+		3:  4 * initialBackoff,
+		10: 5 * time.Minute,
+		64: 5 * time.Minute,
+	} {
+		if delay := backoff(failures, 5*time.Minute); delay < expected/2 || delay >= expected {
+			t.Errorf("expected a delay between %s and %s after %d failures, got %s", expected/2, expected, failures, delay)
+		}
+	}
+}
+
+func TestLookupConnectInfo(t *testing.T) {
+	cache := &Cache{
+		ctx:         context.Background(),
+		clusterInfo: &Map{"10.0.0.1": {Name: "a", Endpoint: "10.0.0.1"}},
+		misses:      make(map[string]time.Time),
+		lastAttempt: time.Now(),
+	}
+
+	if info := cache.LookupConnectInfo(context.Background(), "10.0.0.1:443"); info == nil || info.Name != "a" {
+		t.Errorf("expected cluster a, got %v", info)
+	}
+
+	// refreshed recently, so the refresh on demand is skipped
+	if refreshed, err := cache.RequestRefresh(context.Background()); refreshed || err != nil {
+		t.Errorf("expected the refresh on demand to be rate limited, got %v, %v", refreshed, err)
+	}
+	if info := cache.LookupConnectInfo(context.Background(), "10.0.0.2:443"); info != nil {
+		t.Errorf("expected no cluster, got %v", info)
+	}
+	if !cache.recentlyMissed("10.0.0.2") {
+		t.Errorf("expected the endpoint which was not found to be remembered")
+	}
+	if cache.LookupConnectInfo(context.Background(), "example.com:443"); cache.recentlyMissed("example.com") {
+		t.Errorf("expected host names not to be looked up on demand")
+	}
+
+	if info := cache.GetConnectInfoOrRefresh("10.0.0.3:443"); info != nil || !cache.recentlyMissed("10.0.0.3") {
+		t.Errorf("expected no cluster without waiting for the refresh, and the endpoint to be remembered, got %v", info)
+	}
+	if info := cache.GetConnectInfoOrRefresh("10.0.0.1:443"); info == nil || info.Name != "a" {
+		t.Errorf("expected cluster a, got %v", info)
+	}
+}
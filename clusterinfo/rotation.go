@@ -0,0 +1,93 @@
+package clusterinfo
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/binxio/simple-iap-proxy/metrics"
+	"google.golang.org/api/container/v1"
+	"google.golang.org/api/option"
+)
+
+// caRotationWindow is the time the previous CA of a cluster is accepted after a rotation of the CA, so that
+// masters which still present a certificate signed by the previous CA are trusted during the rotation
+const caRotationWindow = 24 * time.Hour
+
+// acceptPreviousCAs adds the previous CA of the clusters of which the CA changed to the root CAs of the current
+// connect information, and keeps the previous CA of earlier rotations until the end of the rotation window.
+func acceptPreviousCAs(previous, current Map, now time.Time) {
+	before := byCluster(previous)
+	for _, info := range current {
+		old, ok := before[clusterKey(info)]
+		if !ok || old == info || info.previousCaCertificate != "" {
+			continue
+		}
+		switch {
+		case old.ClusterCaCertificate != info.ClusterCaCertificate:
+			info.acceptPreviousCA(old.ClusterCaCertificate, now.Add(caRotationWindow))
+		case old.previousCaCertificate != "" && now.Before(old.previousCaUntil):
+			info.acceptPreviousCA(old.previousCaCertificate, old.previousCaUntil)
+		}
+	}
+}
+
+// acceptPreviousCA trusts the previous CA certificate in addition to the current one until the time
+func (info *ConnectInfo) acceptPreviousCA(previousCaCertificate string, until time.Time) {
+	info.previousCaCertificate = previousCaCertificate
+	info.previousCaUntil = until
+	info.RootCAs = createCertPool(info.Name, info.ClusterCaCertificate, previousCaCertificate)
+}
+
+// RefreshCluster retrieves the connect information of the cluster at the endpoint now, for instance when the
+// certificate of the master can no longer be verified because the CA was rotated. The cluster is refreshed at
+// most once every minOnDemandInterval; otherwise the current connect information is returned.
+func (c *Cache) RefreshCluster(ctx context.Context, endpoint string) (*ConnectInfo, error) {
+	c.refreshMutex.Lock()
+	defer c.refreshMutex.Unlock()
+
+	info := c.GetConnectInfoForEndpoint(endpoint)
+	if info == nil {
+		return nil, fmt.Errorf("%s is not a cluster endpoint", endpoint)
+	}
+	if c.clusterRefreshes == nil {
+		c.clusterRefreshes = make(map[string]time.Time)
+	}
+	if time.Since(c.clusterRefreshes[info.Endpoint]) < minOnDemandInterval {
+		return info, nil
+	}
+	c.clusterRefreshes[info.Endpoint] = time.Now()
+
+	cluster, err := c.retrieveCluster(ctx, info.Location, info.Name)
+	metrics.ClusterCacheRefreshes.WithLabelValues(metrics.Result(err)).Inc()
+	if err != nil {
+		return nil, fmt.Errorf("failed to refresh cluster %s, %s", info.Name, err)
+	}
+	refreshed := newConnectInfo(cluster)
+
+	clusterInfo := make(Map)
+	for k, v := range *c.getClusterInfo() {
+		if k != info.Endpoint {
+			clusterInfo[k] = v
+		}
+	}
+	if cluster.Status != "RUNNING" {
+		slog.Info("removing cluster", "cluster", cluster.Name, "status", cluster.Status)
+		c.updateClusterInfo(&clusterInfo, false)
+		return nil, fmt.Errorf("cluster %s is %s", cluster.Name, cluster.Status)
+	}
+	clusterInfo[refreshed.Endpoint] = refreshed
+	c.updateClusterInfo(&clusterInfo, false)
+	return refreshed, nil
+}
+
+func (c *Cache) retrieveCluster(ctx context.Context, location, name string) (*container.Cluster, error) {
+	service, err := container.NewService(ctx,
+		option.WithTokenSource(c.credentials.TokenSource))
+	if err != nil {
+		return nil, err
+	}
+	return service.Projects.Locations.Clusters.Get(
+		fmt.Sprintf("projects/%s/locations/%s/clusters/%s", c.projectID, location, name)).Context(ctx).Do()
+}
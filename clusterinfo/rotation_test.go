@@ -0,0 +1,33 @@
+package clusterinfo
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAcceptPreviousCAs(t *testing.T) {
+	now := time.Now()
+	previous := Map{
+		"10.0.0.1": {Name: "a", Location: "europe-west4", Endpoint: "10.0.0.1", ClusterCaCertificate: "ca-a"},
+		"10.0.0.2": {Name: "b", Location: "europe-west4", Endpoint: "10.0.0.2", ClusterCaCertificate: "ca-b2",
+			previousCaCertificate: "ca-b1", previousCaUntil: now.Add(time.Hour)},
+		"10.0.0.3": {Name: "c", Location: "europe-west4", Endpoint: "10.0.0.3", ClusterCaCertificate: "ca-c2",
+			previousCaCertificate: "ca-c1", previousCaUntil: now.Add(-time.Hour)},
+	}
+	current := Map{
+		"10.0.0.1": {Name: "a", Location: "europe-west4", Endpoint: "10.0.0.1", ClusterCaCertificate: "ca-a2"},
+		"10.0.0.2": {Name: "b", Location: "europe-west4", Endpoint: "10.0.0.2", ClusterCaCertificate: "ca-b2"},
+		"10.0.0.3": {Name: "c", Location: "europe-west4", Endpoint: "10.0.0.3", ClusterCaCertificate: "ca-c2"},
+	}
+	acceptPreviousCAs(previous, current, now)
+
+	if a := current["10.0.0.1"]; a.previousCaCertificate != "ca-a" || !a.previousCaUntil.Equal(now.Add(caRotationWindow)) {
+		t.Errorf("expected the previous CA of a rotated cluster to be accepted, got %q until %s", a.previousCaCertificate, a.previousCaUntil)
+	}
+	if b := current["10.0.0.2"]; b.previousCaCertificate != "ca-b1" {
+		t.Errorf("expected the previous CA to be accepted during the rotation window, got %q", b.previousCaCertificate)
+	}
+	if c := current["10.0.0.3"]; c.previousCaCertificate != "" {
+		t.Errorf("expected the previous CA not to be accepted after the rotation window, got %q", c.previousCaCertificate)
+	}
+}
@@ -0,0 +1,351 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// CACommand represents the command to install, uninstall and export the client CA
+type CACommand struct {
+	RootCommand
+	Store           string
+	NSSDatabase     string
+	Name            string
+	Output          string
+	WithSystemRoots bool
+}
+
+// systemStore is a directory of trusted certificates with the command to update the system trust store
+type systemStore struct {
+	directory string
+	update    []string
+}
+
+// systemStores are the Linux trust store directories, in order of preference
+var systemStores = []systemStore{
+	{"/usr/local/share/ca-certificates", []string{"update-ca-certificates"}},
+	{"/etc/pki/ca-trust/source/anchors", []string{"update-ca-trust", "extract"}},
+	{"/etc/ca-certificates/trust-source/anchors", []string{"trust", "extract-compat"}},
+}
+
+// systemRootFiles are the bundles of system root certificates, as searched by crypto/x509
+var systemRootFiles = []string{
+	"/etc/ssl/certs/ca-certificates.crt",
+	"/etc/pki/tls/certs/ca-bundle.crt",
+	"/etc/ssl/ca-bundle.pem",
+	"/etc/pki/tls/cacert.pem",
+	"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem",
+	"/etc/ssl/cert.pem",
+}
+
+// NewCACmd creates the ca command with the install, uninstall and export sub commands
+func NewCACmd() *cobra.Command {
+	c := CACommand{
+		RootCommand: RootCommand{
+			Command: cobra.Command{
+				Use:   "ca",
+				Short: "manages the client CA in the local trust store",
+				Long: `
+installs the certificate of the client in the system trust store or in an NSS database
+for browsers, removes it again, or exports it as a bundle with the system roots.
+`,
+			},
+		},
+	}
+	c.PersistentFlags().StringVarP(&c.CertificateFile, "certificate-file", "c", "", "certificate of the client, defaults to the certificate generated by the client")
+	c.MarkPersistentFlagFilename("certificate-file")
+	c.AddKeyPassphraseFlags(c.PersistentFlags())
+	c.PersistentFlags().StringVarP(&c.Name, "name", "", "simple-iap-proxy", "of the certificate in the trust store")
+	c.SilenceUsage = true
+
+	install := &cobra.Command{
+		Use:   "install",
+		Short: "installs the client CA in the trust store",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return c.Install()
+		},
+	}
+	uninstall := &cobra.Command{
+		Use:   "uninstall",
+		Short: "removes the client CA from the trust store",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return c.Uninstall()
+		},
+	}
+	for _, sub := range []*cobra.Command{install, uninstall} {
+		sub.Flags().StringVarP(&c.Store, "store", "", "system", "to use, either system or nss")
+		sub.Flags().StringVarP(&c.NSSDatabase, "nss-database", "", defaultNSSDatabase(), "to use for the nss store")
+	}
+
+	export := &cobra.Command{
+		Use:   "export",
+		Short: "exports the client CA as a bundle, for use as SSL_CERT_FILE",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return c.Export()
+		},
+	}
+	export.Flags().StringVarP(&c.Output, "output", "o", "", "file to write the bundle to, defaults to stdout")
+	export.Flags().BoolVarP(&c.WithSystemRoots, "with-system-roots", "", true, "combine the CA with the system root certificates")
+
+	c.AddCommand(install, uninstall, export)
+	return &c.Command
+}
+
+func defaultNSSDatabase() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return "sql:" + filepath.Join(home, ".pki", "nssdb")
+}
+
+// Install the client CA in the trust store, unless it is already installed
+func (c *CACommand) Install() error {
+	certificate, err := c.readCertificate()
+	if err != nil {
+		return err
+	}
+
+	switch c.Store {
+	case "system":
+		return c.installSystem(certificate)
+	case "nss":
+		return c.installNSS(certificate)
+	default:
+		return fmt.Errorf("unsupported store %s, expected system or nss", c.Store)
+	}
+}
+
+// Uninstall the client CA from the trust store
+func (c *CACommand) Uninstall() error {
+	switch c.Store {
+	case "system":
+		return c.uninstallSystem()
+	case "nss":
+		return c.uninstallNSS()
+	default:
+		return fmt.Errorf("unsupported store %s, expected system or nss", c.Store)
+	}
+}
+
+// Export the client CA, optionally combined with the system roots
+func (c *CACommand) Export() error {
+	certificate, err := c.readCertificate()
+	if err != nil {
+		return err
+	}
+
+	bundle, err := exportBundle(certificate, c.WithSystemRoots)
+	if err != nil {
+		return err
+	}
+
+	if c.Output == "" {
+		_, err = os.Stdout.Write(bundle)
+		return err
+	}
+	if err = os.WriteFile(c.Output, bundle, 0o644); err != nil {
+		return fmt.Errorf("failed to write %s, %s", c.Output, err)
+	}
+	slog.Info("exported CA, use it with SSL_CERT_FILE", "file", c.Output)
+	return nil
+}
+
+// readCertificate reads the client CA as PEM from the certificate file, which may be a PKCS#12 bundle. Without
+// a certificate file, the certificate generated by the client in the user config directory is read.
+func (c *CACommand) readCertificate() ([]byte, error) {
+	if c.CertificateFile == "" {
+		_, certificateFile, err := defaultCertificateFiles()
+		if err != nil {
+			return nil, fmt.Errorf("--certificate-file is required, %s", err)
+		}
+		if _, err = os.Stat(certificateFile); os.IsNotExist(err) {
+			return nil, fmt.Errorf("no certificate generated by the client in %s, start the client first or specify --certificate-file", certificateFile)
+		}
+		c.CertificateFile = certificateFile
+	}
+	data, err := os.ReadFile(c.CertificateFile)
+	if err != nil {
+		return nil, fmt.Errorf("%s, %s", c.CertificateFile, err)
+	}
+
+	var certificate *x509.Certificate
+	if isPEM(data) {
+		block, rest := pem.Decode(data)
+		for block != nil && block.Type != "CERTIFICATE" {
+			block, rest = pem.Decode(rest)
+		}
+		if block == nil {
+			return nil, fmt.Errorf("%s does not contain a certificate", c.CertificateFile)
+		}
+		certificate, err = x509.ParseCertificate(block.Bytes)
+	} else {
+		var passphrase []byte
+		if passphrase, err = c.KeyPassphrase(); err != nil {
+			return nil, err
+		}
+		_, certificate, _, err = pkcs12.DecodeChain(data, string(passphrase))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate from %s, %s", c.CertificateFile, err)
+	}
+
+	if !certificate.IsCA {
+		slog.Warn("certificate is not a certificate authority, the client cannot sign certificates with it", "file", c.CertificateFile)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw}), nil
+}
+
+// findSystemStore returns the trust store directory of this system
+func findSystemStore() (*systemStore, error) {
+	if runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("the system store is not supported on %s, use ca export instead", runtime.GOOS)
+	}
+	for i := range systemStores {
+		if info, err := os.Stat(systemStores[i].directory); err == nil && info.IsDir() {
+			return &systemStores[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no system trust store directory found, use ca export instead")
+}
+
+func (c *CACommand) installSystem(certificate []byte) error {
+	store, err := findSystemStore()
+	if err != nil {
+		return err
+	}
+
+	filename := filepath.Join(store.directory, c.Name+".crt")
+	if existing, err := os.ReadFile(filename); err == nil && bytes.Equal(existing, certificate) {
+		slog.Info("CA is already installed", "file", filename)
+		return nil
+	}
+
+	if err = os.WriteFile(filename, certificate, 0o644); err != nil {
+		return fmt.Errorf("failed to write %s, %s. Are you root?", filename, err)
+	}
+	slog.Info("installed CA", "file", filename)
+	return runCommand(store.update)
+}
+
+func (c *CACommand) uninstallSystem() error {
+	store, err := findSystemStore()
+	if err != nil {
+		return err
+	}
+
+	filename := filepath.Join(store.directory, c.Name+".crt")
+	if err = os.Remove(filename); err != nil {
+		if os.IsNotExist(err) {
+			slog.Info("CA is not installed", "file", filename)
+			return nil
+		}
+		return fmt.Errorf("failed to remove %s, %s. Are you root?", filename, err)
+	}
+	slog.Info("removed CA", "file", filename)
+	return runCommand(store.update)
+}
+
+func (c *CACommand) installNSS(certificate []byte) error {
+	if installed, err := c.nssCertificate(); err == nil && bytes.Equal(installed, certificate) {
+		slog.Info("CA is already installed", "name", c.Name, "database", c.NSSDatabase)
+		return nil
+	}
+
+	cmd := exec.Command("certutil", "-A", "-d", c.NSSDatabase, "-t", "C,,", "-n", c.Name)
+	cmd.Stdin = bytes.NewReader(certificate)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to add CA to %s, %s: %s", c.NSSDatabase, err, strings.TrimSpace(string(output)))
+	}
+	slog.Info("installed CA", "name", c.Name, "database", c.NSSDatabase)
+	return nil
+}
+
+func (c *CACommand) uninstallNSS() error {
+	if _, err := c.nssCertificate(); err != nil {
+		slog.Info("CA is not installed", "name", c.Name, "database", c.NSSDatabase)
+		return nil
+	}
+
+	output, err := exec.Command("certutil", "-D", "-d", c.NSSDatabase, "-n", c.Name).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to remove CA from %s, %s: %s", c.NSSDatabase, err, strings.TrimSpace(string(output)))
+	}
+	slog.Info("removed CA", "name", c.Name, "database", c.NSSDatabase)
+	return nil
+}
+
+// nssCertificate returns the certificate installed under the name in the NSS database as PEM
+func (c *CACommand) nssCertificate() ([]byte, error) {
+	output, err := exec.Command("certutil", "-L", "-d", c.NSSDatabase, "-n", c.Name, "-a").Output()
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(output)
+	if block == nil {
+		return nil, fmt.Errorf("no certificate named %s", c.Name)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: block.Bytes}), nil
+}
+
+// exportBundle returns the certificate, preceded by the system roots if requested
+func exportBundle(certificate []byte, withSystemRoots bool) ([]byte, error) {
+	if !withSystemRoots {
+		return certificate, nil
+	}
+
+	roots, err := readSystemRoots()
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Contains(roots, certificate) {
+		return roots, nil
+	}
+
+	bundle := bytes.NewBuffer(roots)
+	if len(roots) > 0 && !bytes.HasSuffix(roots, []byte("\n")) {
+		bundle.WriteString("\n")
+	}
+	bundle.Write(certificate)
+	return bundle.Bytes(), nil
+}
+
+// readSystemRoots returns the bundle of system root certificates, from SSL_CERT_FILE or the first bundle found
+func readSystemRoots() ([]byte, error) {
+	files := systemRootFiles
+	if filename := os.Getenv("SSL_CERT_FILE"); filename != "" {
+		files = []string{filename}
+	}
+	for _, filename := range files {
+		roots, err := os.ReadFile(filename)
+		if err == nil {
+			return roots, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s, %s", filename, err)
+		}
+	}
+	return nil, fmt.Errorf("no system root certificates found, use --with-system-roots=false")
+}
+
+func runCommand(args []string) error {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = io.Discard
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to run %s, %s", strings.Join(args, " "), err)
+	}
+	return nil
+}
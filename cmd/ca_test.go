@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExportBundle(t *testing.T) {
+	roots := filepath.Join(t.TempDir(), "roots.pem")
+	if err := os.WriteFile(roots, []byte("-----BEGIN CERTIFICATE-----\nroot\n-----END CERTIFICATE-----"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SSL_CERT_FILE", roots)
+
+	c := &CACommand{}
+	c.CertificateFile = generateTestCertificate(t, "ecdsa-p256", "").CertificateFile
+	certificate, err := c.readCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bundle, err := exportBundle(certificate, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(bundle, []byte("-----BEGIN CERTIFICATE-----\nroot\n-----END CERTIFICATE-----\n")) || !bytes.HasSuffix(bundle, certificate) {
+		t.Errorf("expected the bundle to contain the system roots followed by the CA, got %s", bundle)
+	}
+
+	if err = os.WriteFile(roots, bundle, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	again, err := exportBundle(certificate, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again, bundle) {
+		t.Errorf("expected the CA not to be added twice")
+	}
+}
@@ -0,0 +1,159 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/youmark/pkcs8"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// KeyPassphrase returns the passphrase of the private key from the environment variable or file, or nil if none is specified
+func (c *RootCommand) KeyPassphrase() ([]byte, error) {
+	if c.KeyPassphraseEnv != "" && c.KeyPassphraseFile != "" {
+		return nil, fmt.Errorf("specify either --key-passphrase-env or --key-passphrase-file, not both")
+	}
+	if c.KeyPassphraseEnv != "" {
+		passphrase, ok := os.LookupEnv(c.KeyPassphraseEnv)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", c.KeyPassphraseEnv)
+		}
+		return []byte(passphrase), nil
+	}
+	if c.KeyPassphraseFile != "" {
+		passphrase, err := os.ReadFile(c.KeyPassphraseFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s, %s", c.KeyPassphraseFile, err)
+		}
+		return bytes.TrimRight(passphrase, "\r\n"), nil
+	}
+	return nil, nil
+}
+
+// LoadCertificate loads the key and certificate specified by the flags
+func (c *RootCommand) LoadCertificate() (*tls.Certificate, error) {
+	passphrase, err := c.KeyPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	return LoadCertificate(c.KeyFile, c.CertificateFile, passphrase)
+}
+
+// LoadCertificate loads the key and certificate from PEM files, or from a PKCS#12 bundle. The
+// key may be in PKCS#1, SEC 1 or PKCS#8 format, the latter optionally encrypted with the passphrase.
+// For a PKCS#12 bundle, the key is read from the bundle and the key file is ignored.
+func LoadCertificate(keyFile, certificateFile string, passphrase []byte) (*tls.Certificate, error) {
+	certPEM, err := os.ReadFile(certificateFile)
+	if err != nil {
+		return nil, fmt.Errorf("%s, %s", certificateFile, err)
+	}
+
+	if !isPEM(certPEM) {
+		return loadPKCS12(certificateFile, certPEM, passphrase)
+	}
+
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("%s, %s", keyFile, err)
+	}
+
+	keyPEM, err = decryptPrivateKey(keyPEM, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("%s, %s", keyFile, err)
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate, %s", err)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, fmt.Errorf("failed to parse certificate, %s", err)
+	}
+
+	return &cert, nil
+}
+
+func isPEM(data []byte) bool {
+	block, _ := pem.Decode(data)
+	return block != nil
+}
+
+// decryptPrivateKey returns the private key as unencrypted PEM, if it is an encrypted PKCS#8 key
+func decryptPrivateKey(keyPEM []byte, passphrase []byte) ([]byte, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil || block.Type != "ENCRYPTED PRIVATE KEY" {
+		return keyPEM, nil
+	}
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("private key is encrypted, specify --key-passphrase-env or --key-passphrase-file")
+	}
+	key, err := pkcs8.ParsePKCS8PrivateKey(block.Bytes, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt private key, %s", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal private key, %s", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+func loadPKCS12(filename string, data []byte, passphrase []byte) (*tls.Certificate, error) {
+	key, leaf, chain, err := pkcs12.DecodeChain(data, string(passphrase))
+	if err != nil {
+		return nil, fmt.Errorf("%s is neither PEM nor a PKCS#12 bundle, %s", filename, err)
+	}
+
+	cert := tls.Certificate{PrivateKey: key, Leaf: leaf}
+	cert.Certificate = append(cert.Certificate, leaf.Raw)
+	for _, c := range chain {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	return &cert, nil
+}
+
+// EncodePrivateKey returns the private key in PKCS#8 PEM format, encrypted if a passphrase is specified
+func EncodePrivateKey(key interface{}, passphrase []byte) ([]byte, error) {
+	der, err := pkcs8.MarshalPrivateKey(key, passphrase, nil)
+	if err != nil {
+		return nil, err
+	}
+	blockType := "PRIVATE KEY"
+	if len(passphrase) > 0 {
+		blockType = "ENCRYPTED PRIVATE KEY"
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), nil
+}
+
+// KeyTypes lists the supported types of generated keys
+var KeyTypes = []string{"rsa2048", "rsa4096", "ecdsa-p256", "ecdsa-p384", "ed25519"}
+
+// GenerateKey generates a private key of the specified type
+func GenerateKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case "rsa2048":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case "rsa4096":
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case "ecdsa-p256":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ecdsa-p384":
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	default:
+		return nil, fmt.Errorf("unsupported key type %s, expected one of %s", keyType, strings.Join(KeyTypes, ", "))
+	}
+}
@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"crypto/x509"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func generateTestCertificate(t *testing.T, keyType string, passphrase string) *GenerateCertificate {
+	dir := t.TempDir()
+	t.Setenv("TEST_KEY_PASSPHRASE", passphrase)
+
+	c := &GenerateCertificate{
+		DNSNames:   []string{"localhost"},
+		CommonName: "test",
+		Validity:   time.Hour,
+		KeyType:    keyType,
+		PKCS12File: filepath.Join(dir, "server.p12"),
+	}
+	c.KeyFile = filepath.Join(dir, "server.key")
+	c.CertificateFile = filepath.Join(dir, "server.crt")
+	if passphrase != "" {
+		c.KeyPassphraseEnv = "TEST_KEY_PASSPHRASE"
+	}
+	if err := c.Run(); err != nil {
+		t.Fatalf("failed to generate %s certificate, %s", keyType, err)
+	}
+	return c
+}
+
+func TestLoadCertificate(t *testing.T) {
+	for _, keyType := range KeyTypes {
+		for _, passphrase := range []string{"", "secret"} {
+			c := generateTestCertificate(t, keyType, passphrase)
+
+			cert, err := c.LoadCertificate()
+			if err != nil {
+				t.Fatalf("failed to load %s certificate with passphrase %q, %s", keyType, passphrase, err)
+			}
+			if cert.Leaf.Subject.CommonName != "test" {
+				t.Errorf("expected common name test, got %s", cert.Leaf.Subject.CommonName)
+			}
+
+			bundle, err := LoadCertificate("", c.PKCS12File, []byte(passphrase))
+			if err != nil {
+				t.Fatalf("failed to load %s PKCS#12 bundle with passphrase %q, %s", keyType, passphrase, err)
+			}
+			if bundle.PrivateKey == nil || bundle.Leaf.SerialNumber.Cmp(cert.Leaf.SerialNumber) != 0 {
+				t.Errorf("expected the PKCS#12 bundle to contain the key and certificate")
+			}
+		}
+	}
+}
+
+func TestLoadEncryptedKeyWithoutPassphrase(t *testing.T) {
+	c := generateTestCertificate(t, "ecdsa-p256", "secret")
+
+	if _, err := LoadCertificate(c.KeyFile, c.CertificateFile, nil); err == nil {
+		t.Fatalf("expected an error loading an encrypted key without passphrase")
+	}
+	if _, err := LoadCertificate(c.KeyFile, c.CertificateFile, []byte("wrong")); err == nil {
+		t.Fatalf("expected an error loading an encrypted key with the wrong passphrase")
+	}
+}
+
+func TestGenerateSignedCertificate(t *testing.T) {
+	dir := t.TempDir()
+	ca := &GenerateCertificate{CA: true, Validity: time.Hour, KeyType: "ecdsa-p256"}
+	ca.KeyFile, ca.CertificateFile = filepath.Join(dir, "ca.key"), filepath.Join(dir, "ca.crt")
+	if err := ca.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	server := &GenerateCertificate{
+		DNSNames:          []string{"gke-server.internal"},
+		Validity:          time.Hour,
+		KeyType:           "ecdsa-p256",
+		CAKeyFile:         ca.KeyFile,
+		CACertificateFile: ca.CertificateFile,
+	}
+	server.KeyFile, server.CertificateFile = filepath.Join(dir, "server.key"), filepath.Join(dir, "server.crt")
+	if err := server.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	caCertificate, err := LoadCertificate(ca.KeyFile, ca.CertificateFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCertificate, err := LoadCertificate(server.KeyFile, server.CertificateFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := serverCertificate.Leaf
+	if leaf.Issuer.String() == leaf.Subject.String() {
+		t.Errorf("expected the issuer %s to differ from the subject, as OpenSSL takes it for self-signed", leaf.Issuer)
+	}
+	if leaf.Subject.CommonName != "gke-server.internal" {
+		t.Errorf("expected the common name to default to the dns name, got %s", leaf.Subject.CommonName)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(caCertificate.Leaf)
+	if _, err = leaf.Verify(x509.VerifyOptions{Roots: roots, DNSName: "gke-server.internal"}); err != nil {
+		t.Errorf("expected the certificate to verify against the CA, %s", err)
+	}
+}
@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// defaultCertificate returns the generator of the certificate used when no key and certificate file are specified
+func defaultCertificate() *GenerateCertificate {
+	return &GenerateCertificate{
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []string{"127.0.0.1", "::1"},
+		CommonName:  "simple-iap-proxy",
+		Validity:    10 * 365 * 24 * time.Hour,
+		KeyType:     "ecdsa-p256",
+	}
+}
+
+// defaultCertificateFiles returns the key and certificate file of the generated certificate in the user config directory
+func defaultCertificateFiles() (string, string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", "", err
+	}
+	dir := filepath.Join(configDir, "simple-iap-proxy")
+	return filepath.Join(dir, "ca.key"), filepath.Join(dir, "ca.crt"), nil
+}
+
+// resolveCertificateFiles sets the key and certificate file to the generated certificate in the user config
+// directory when neither is specified, generating it on first use. Returns false if the certificate must be
+// generated in memory instead.
+func (c *RootCommand) resolveCertificateFiles() (bool, error) {
+	if c.KeyFile != "" && c.CertificateFile != "" {
+		return true, nil
+	}
+	if c.KeyFile != "" || c.CertificateFile != "" {
+		return false, fmt.Errorf("specify both --key-file and --certificate-file, or neither")
+	}
+	if c.EphemeralCertificate {
+		return false, nil
+	}
+
+	keyFile, certificateFile, err := defaultCertificateFiles()
+	if err != nil {
+		slog.Warn("no user config directory to store the certificate in, generating it in memory", "error", err)
+		return false, nil
+	}
+
+	dir := filepath.Dir(certificateFile)
+	c.KeyFile, c.CertificateFile = keyFile, certificateFile
+	if _, err = os.Stat(c.CertificateFile); err == nil {
+		slog.Info("using the generated certificate", "file", c.CertificateFile)
+		return true, nil
+	}
+
+	if err = os.MkdirAll(dir, 0o700); err != nil {
+		return false, fmt.Errorf("failed to create directory %s, %s", dir, err)
+	}
+
+	passphrase, err := c.KeyPassphrase()
+	if err != nil {
+		return false, err
+	}
+	key, derBytes, _, err := defaultCertificate().generate(passphrase)
+	if err != nil {
+		return false, err
+	}
+	if err = writeKeyAndCertificate(c.KeyFile, c.CertificateFile, key, derBytes, passphrase); err != nil {
+		return false, err
+	}
+	slog.Info("generated the certificate on first use", "file", c.CertificateFile)
+	return true, nil
+}
+
+// generateEphemeralCertificate returns a new certificate, which only exists in memory
+func generateEphemeralCertificate() (*tls.Certificate, error) {
+	key, derBytes, _, err := defaultCertificate().generate(nil)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate, %s", err)
+	}
+	slog.Info("using an ephemeral certificate generated in memory")
+	return &tls.Certificate{Certificate: [][]byte{derBytes}, PrivateKey: key, Leaf: leaf}, nil
+}
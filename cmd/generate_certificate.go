@@ -1,24 +1,36 @@
 package cmd
 
 import (
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"fmt"
-	"log"
+	"log/slog"
 	"math/big"
+	"net"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
+	"software.sslmate.com/src/go-pkcs12"
 )
 
 // GenerateCertificate represents the command to generate a certificate
 type GenerateCertificate struct {
 	RootCommand
-	DNSName string
+	DNSNames          []string
+	IPAddresses       []string
+	CommonName        string
+	Validity          time.Duration
+	CA                bool
+	CAKeyFile         string
+	CACertificateFile string
+	KeyType           string
+	PKCS12File        string
 }
 
 // NewGenerateCertificateCmd creates a generate certificate commmand
@@ -31,56 +43,179 @@ func NewGenerateCertificateCmd() *cobra.Command {
 				Long: `
 generates an key and self-signed certificate which can be used to
 serve over HTTPS.
+
+With --ca, a dedicated certificate authority is generated instead, which can
+be used by the client to sign certificates for the targeted hosts. With 
+--ca-key-file and --ca-certificate-file, a server certificate signed by that
+certificate authority is generated, as for the gke-server.
 `,
 			},
 		},
 	}
 
 	c.AddPersistentFlags()
-	c.Flags().StringVarP(&c.DNSName, "dns-name", "", "localhost", "on the certificate")
+	c.MarkPersistentFlagRequired("key-file")
+	c.MarkPersistentFlagRequired("certificate-file")
+	c.PersistentFlags().MarkHidden("ephemeral-certificate")
+	c.Flags().StringSliceVarP(&c.DNSNames, "dns-name", "", []string{"localhost"}, "on the certificate, repeat for multiple names")
+	c.Flags().StringSliceVarP(&c.IPAddresses, "ip-address", "", []string{}, "on the certificate, repeat for multiple addresses")
+	c.Flags().StringVarP(&c.CommonName, "common-name", "", "", "of the certificate subject, defaults to \"simple-iap-proxy CA\" with --ca and the first dns name when signed by a CA")
+	c.Flags().DurationVarP(&c.Validity, "validity", "", 10*365*10*time.Hour, "of the certificate")
+	c.Flags().BoolVarP(&c.CA, "ca", "", false, "generate a certificate authority")
+	c.Flags().StringVarP(&c.CAKeyFile, "ca-key-file", "", "", "key of the certificate authority to sign with")
+	c.Flags().StringVarP(&c.CACertificateFile, "ca-certificate-file", "", "", "certificate of the certificate authority to sign with")
+	c.Flags().StringVarP(&c.KeyType, "key-type", "", "rsa4096", "of the generated key, one of "+strings.Join(KeyTypes, ", "))
+	c.Flags().StringVarP(&c.PKCS12File, "pkcs12-file", "", "", "to write the key and certificate to as a PKCS#12 bundle")
+	c.MarkFlagsRequiredTogether("ca-key-file", "ca-certificate-file")
+	c.MarkFlagsMutuallyExclusive("ca", "ca-key-file")
+	c.Flags().SortFlags = false
 
 	c.RunE = func(cmd *cobra.Command, args []string) error {
-		return generateCertificate(c.KeyFile, c.CertificateFile, c.DNSName)
+		return c.Run()
 	}
 
 	return &c.Command
 }
 
-func generateCertificate(keyFile, certificateFile, dnsName string) error {
+// Run generates the key and certificate
+func (c *GenerateCertificate) Run() error {
+	passphrase, err := c.KeyPassphrase()
+	if err != nil {
+		return err
+	}
+
+	key, derBytes, chain, err := c.generate(passphrase)
+	if err != nil {
+		return err
+	}
+	if err = writeKeyAndCertificate(c.KeyFile, c.CertificateFile, key, derBytes, passphrase); err != nil {
+		return err
+	}
+	if c.PKCS12File != "" {
+		return writePKCS12(c.PKCS12File, key, derBytes, chain, passphrase)
+	}
+	return nil
+}
+
+// generate returns a new key and the certificate for it, with the chain of the signing certificate authority
+func (c *GenerateCertificate) generate(passphrase []byte) (crypto.Signer, []byte, []*x509.Certificate, error) {
+	template, err := c.template()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	key, err := GenerateKey(c.KeyType)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to generate private key: %s", err)
+	}
+	if !c.CA && !isRSAKey(key) {
+		template.KeyUsage &^= x509.KeyUsageKeyEncipherment
+	}
+
+	parent, signer := template, key
+	var chain []*x509.Certificate
+	if c.CAKeyFile != "" {
+		ca, err := LoadCertificate(c.CAKeyFile, c.CACertificateFile, passphrase)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to load certificate authority: %s", err)
+		}
+		parent = ca.Leaf
+		chain = append(chain, parent)
+		if !parent.IsCA {
+			return nil, nil, nil, fmt.Errorf("%s is not a certificate authority", c.CACertificateFile)
+		}
+		if template.NotAfter.After(parent.NotAfter) {
+			template.NotAfter = parent.NotAfter
+		}
+		signer = ca.PrivateKey.(crypto.Signer)
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), signer)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to create certificate: %s", err)
+	}
+	return key, derBytes, chain, nil
+}
+
+// template returns the certificate template with the key usages of a certificate authority, a server
+// certificate or, by default, a self-signed certificate which is both.
+func (c *GenerateCertificate) template() (*x509.Certificate, error) {
 	template := x509.Certificate{}
 	template.Subject = pkix.Name{
 		Organization: []string{"binx.io B.V."},
 		Country:      []string{"NL"},
-		CommonName:   "simple-iap-proxy",
+		CommonName:   c.commonName(),
 	}
 
 	template.NotBefore = time.Now()
-	template.NotAfter = template.NotBefore.Add(10 * 365 * 10 * time.Hour)
-	template.KeyUsage = x509.KeyUsageCertSign |
-		x509.KeyUsageKeyEncipherment |
-		x509.KeyUsageDigitalSignature |
-		x509.KeyUsageCRLSign
-	template.ExtKeyUsage = []x509.ExtKeyUsage{
-		x509.ExtKeyUsageClientAuth,
-		x509.ExtKeyUsageServerAuth,
-	}
-	template.IsCA = true
+	template.NotAfter = template.NotBefore.Add(c.Validity)
 	template.BasicConstraintsValid = true
-	template.DNSNames = []string{dnsName}
 
-	key, err := rsa.GenerateKey(rand.Reader, 4096)
-	if err != nil {
-		return fmt.Errorf("failed to generate private key: %s", err)
+	switch {
+	case c.CA:
+		template.IsCA = true
+		template.KeyUsage = x509.KeyUsageCertSign |
+			x509.KeyUsageDigitalSignature |
+			x509.KeyUsageCRLSign
+	case c.CAKeyFile != "":
+		template.KeyUsage = x509.KeyUsageKeyEncipherment |
+			x509.KeyUsageDigitalSignature
+		template.ExtKeyUsage = []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth,
+		}
+	default:
+		template.IsCA = true
+		template.KeyUsage = x509.KeyUsageCertSign |
+			x509.KeyUsageKeyEncipherment |
+			x509.KeyUsageDigitalSignature |
+			x509.KeyUsageCRLSign
+		template.ExtKeyUsage = []x509.ExtKeyUsage{
+			x509.ExtKeyUsageClientAuth,
+			x509.ExtKeyUsageServerAuth,
+		}
+	}
+
+	if !c.CA {
+		template.DNSNames = c.DNSNames
+		for _, address := range c.IPAddresses {
+			ip := net.ParseIP(address)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip address %s", address)
+			}
+			template.IPAddresses = append(template.IPAddresses, ip)
+		}
 	}
+
+	var err error
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	template.SerialNumber, err = rand.Int(rand.Reader, serialNumberLimit)
 	if err != nil {
-		return fmt.Errorf("failed to generate serial number: %s", err)
+		return nil, fmt.Errorf("failed to generate serial number: %s", err)
 	}
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
-	if err != nil {
-		return fmt.Errorf("failed to create certificate: %s", err)
+	return &template, nil
+}
+
+// commonName returns the common name of the subject. A signed certificate must not have the subject of its
+// certificate authority, as OpenSSL takes a certificate whose issuer equals its subject for self-signed.
+func (c *GenerateCertificate) commonName() string {
+	switch {
+	case c.CommonName != "":
+		return c.CommonName
+	case c.CA:
+		return "simple-iap-proxy CA"
+	case c.CAKeyFile != "" && len(c.DNSNames) > 0:
+		return c.DNSNames[0]
+	default:
+		return "simple-iap-proxy"
 	}
+}
+
+func isRSAKey(key crypto.Signer) bool {
+	_, ok := key.(*rsa.PrivateKey)
+	return ok
+}
+
+func writeKeyAndCertificate(keyFile, certificateFile string, key crypto.Signer, derBytes []byte, passphrase []byte) error {
 	certOut, err := os.Create(certificateFile)
 	if err != nil {
 		return fmt.Errorf("failed to open %s for writing: %s", certificateFile, err)
@@ -98,17 +233,41 @@ func generateCertificate(keyFile, certificateFile, dnsName string) error {
 		return fmt.Errorf("failed to write certificate into %s: %s", certificateFile, err)
 	}
 
-	err = pem.Encode(keyOut, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	keyPEM, err := EncodePrivateKey(key, passphrase)
 	if err != nil {
+		return fmt.Errorf("failed to encode private key: %s", err)
+	}
+	if _, err = keyOut.Write(keyPEM); err != nil {
 		return fmt.Errorf("failed to write private key into %s: %s", keyFile, err)
 	}
 
 	return nil
 }
 
+func writePKCS12(filename string, key crypto.Signer, derBytes []byte, chain []*x509.Certificate, passphrase []byte) error {
+	cert, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		return fmt.Errorf("failed to parse certificate: %s", err)
+	}
+
+	encoder := pkcs12.Modern
+	if len(passphrase) == 0 {
+		encoder = pkcs12.Passwordless
+	}
+	bundle, err := encoder.Encode(key, cert, chain, string(passphrase))
+	if err != nil {
+		return fmt.Errorf("failed to encode PKCS#12 bundle: %s", err)
+	}
+
+	if err = os.WriteFile(filename, bundle, 0o600); err != nil {
+		return fmt.Errorf("failed to write PKCS#12 bundle into %s: %s", filename, err)
+	}
+	return nil
+}
+
 func closeWithWarningOnError(f *os.File) {
 	err := f.Close()
 	if err != nil {
-		log.Printf("WARNING: failed to close file %s, %s", f.Name(), err)
+		slog.Warn("failed to close file", "file", f.Name(), "error", err)
 	}
 }
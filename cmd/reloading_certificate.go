@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// certificateWatchInterval is the interval at which the key and certificate files are checked for changes
+const certificateWatchInterval = 10 * time.Second
+
+// ReloadingCertificate holds the certificate loaded from the key and certificate file, which is
+// reloaded when the files change or the process receives a SIGHUP.
+type ReloadingCertificate struct {
+	load        func() (*tls.Certificate, error)
+	files       []string
+	mutex       sync.RWMutex
+	certificate *tls.Certificate
+	versions    map[string]fileVersion
+	onReload    []func(*tls.Certificate)
+}
+
+// fileVersion identifies the content of a file by modification time and size
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+// NewReloadingCertificate loads the certificate specified by the flags, and reloads it until the context is done. When
+// no key and certificate file are specified, a generated certificate is used.
+func (c *RootCommand) NewReloadingCertificate(ctx context.Context) (*ReloadingCertificate, error) {
+	fromFiles, err := c.resolveCertificateFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &ReloadingCertificate{
+		load:  c.LoadCertificate,
+		files: []string{c.KeyFile, c.CertificateFile},
+	}
+	if !fromFiles {
+		certificate, err := generateEphemeralCertificate()
+		if err != nil {
+			return nil, err
+		}
+		r.load = func() (*tls.Certificate, error) { return certificate, nil }
+		r.files = nil
+	}
+	if c.KeyPassphraseFile != "" {
+		r.files = append(r.files, c.KeyPassphraseFile)
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	go r.watch(ctx)
+	return r, nil
+}
+
+// Certificate returns the current certificate
+func (r *ReloadingCertificate) Certificate() *tls.Certificate {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.certificate
+}
+
+// GetCertificate returns the current certificate, for use in tls.Config
+func (r *ReloadingCertificate) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.Certificate(), nil
+}
+
+// OnReload registers a function which is called with the new certificate after each reload
+func (r *ReloadingCertificate) OnReload(f func(*tls.Certificate)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.onReload = append(r.onReload, f)
+}
+
+// Reload loads the certificate from the files. On failure, the current certificate is kept.
+func (r *ReloadingCertificate) Reload() error {
+	versions := r.fileVersions()
+	certificate, err := r.load()
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	r.certificate = certificate
+	r.versions = versions
+	onReload := r.onReload
+	r.mutex.Unlock()
+
+	for _, f := range onReload {
+		f(certificate)
+	}
+	return nil
+}
+
+// changed returns true if any of the files changed since the last reload
+func (r *ReloadingCertificate) changed() bool {
+	versions := r.fileVersions()
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for filename, version := range versions {
+		if r.versions[filename] != version {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *ReloadingCertificate) fileVersions() map[string]fileVersion {
+	result := make(map[string]fileVersion, len(r.files))
+	for _, filename := range r.files {
+		if info, err := os.Stat(filename); err == nil {
+			result[filename] = fileVersion{modTime: info.ModTime(), size: info.Size()}
+		}
+	}
+	return result
+}
+
+func (r *ReloadingCertificate) watch(ctx context.Context) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	ticker := time.NewTicker(certificateWatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			slog.Info("received SIGHUP, reloading certificate")
+		case <-ticker.C:
+			if !r.changed() {
+				continue
+			}
+			slog.Info("certificate files changed, reloading certificate")
+		}
+
+		if err := r.Reload(); err != nil {
+			slog.Error("failed to reload certificate, keeping the current one", "error", err)
+			continue
+		}
+		slog.Info("reloaded certificate",
+			"subject", r.Certificate().Leaf.Subject.CommonName, "not_after", r.Certificate().Leaf.NotAfter.Format(time.RFC3339))
+	}
+}
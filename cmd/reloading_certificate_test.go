@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReloadingCertificate(t *testing.T) {
+	c := generateTestCertificate(t, "ecdsa-p256", "")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r, err := c.NewReloadingCertificate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := r.Certificate()
+	if r.changed() {
+		t.Fatalf("expected no change directly after loading")
+	}
+
+	var reloaded *tls.Certificate
+	r.OnReload(func(certificate *tls.Certificate) { reloaded = certificate })
+
+	if err = c.Run(); err != nil {
+		t.Fatal(err)
+	}
+	// ensure the modification time differs on file systems with a coarse resolution
+	past := time.Now().Add(-time.Minute)
+	if err = os.Chtimes(c.CertificateFile, past, past); err != nil {
+		t.Fatal(err)
+	}
+	if !r.changed() {
+		t.Fatalf("expected the certificate files to have changed")
+	}
+	if err = r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if r.Certificate() == first || reloaded != r.Certificate() {
+		t.Errorf("expected the certificate to be reloaded and passed to the reload function")
+	}
+
+	if err = os.WriteFile(c.CertificateFile, []byte("invalid"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.Reload(); err == nil {
+		t.Fatalf("expected an error reloading an invalid certificate")
+	}
+	if r.Certificate() != reloaded {
+		t.Errorf("expected the current certificate to be kept on a failed reload")
+	}
+}
+
+func TestGeneratedCertificate(t *testing.T) {
+	configDir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", configDir)
+	t.Setenv("HOME", configDir)
+	t.Setenv("AppData", configDir)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := (&CACommand{}).readCertificate(); err == nil {
+		t.Errorf("expected an error when the client did not generate a certificate yet")
+	}
+
+	c := &RootCommand{}
+	first, err := c.NewReloadingCertificate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !first.Certificate().Leaf.IsCA || c.CertificateFile == "" {
+		t.Fatalf("expected a CA certificate to be generated in the user config directory")
+	}
+	if installed, err := (&CACommand{}).readCertificate(); err != nil || !bytes.Contains(installed, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: first.Certificate().Leaf.Raw})) {
+		t.Errorf("expected the ca command to default to the generated certificate, got %v", err)
+	}
+
+	c = &RootCommand{}
+	second, err := c.NewReloadingCertificate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !second.Certificate().Leaf.Equal(first.Certificate().Leaf) {
+		t.Errorf("expected the generated certificate to be reused")
+	}
+
+	c = &RootCommand{EphemeralCertificate: true}
+	ephemeral, err := c.NewReloadingCertificate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ephemeral.Certificate().Leaf.Equal(first.Certificate().Leaf) || c.CertificateFile != "" {
+		t.Errorf("expected an ephemeral certificate to be generated in memory")
+	}
+
+	if _, err = (&RootCommand{KeyFile: "server.key"}).NewReloadingCertificate(ctx); err == nil {
+		t.Errorf("expected an error when only the key file is specified")
+	}
+}
@@ -5,31 +5,76 @@ import (
 	"os"
 	"strconv"
 
+	"github.com/binxio/simple-iap-proxy/logging"
+	"github.com/binxio/simple-iap-proxy/tracing"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 // RootCommand the root command with all the global flags
 type RootCommand struct {
 	cobra.Command
-	Debug           bool
-	Port            int
-	ProjectID       string
-	KeyFile         string
-	CertificateFile string
+	Debug                bool
+	Port                 int
+	ProjectID            string
+	KeyFile              string
+	CertificateFile      string
+	KeyPassphraseEnv     string
+	KeyPassphraseFile    string
+	EphemeralCertificate bool
+	MetricsAddress       string
+	Tracing              tracing.Options
+	LogFormat            string
 }
 
 // AddPersistentFlags adds all the persistent flags to the command
 func (c *RootCommand) AddPersistentFlags() {
+	c.AddGlobalPersistentFlags()
+	c.AddCertificatePersistentFlags()
+}
+
+// AddGlobalPersistentFlags adds the persistent flags shared by all commands
+func (c *RootCommand) AddGlobalPersistentFlags() {
 	c.PersistentFlags().SortFlags = false
 	c.PersistentFlags().BoolVarP(&c.Debug, "debug", "d", false, "provide debug information")
 	c.PersistentFlags().IntVarP(&c.Port, "port", "P", getPort(), "port to listen on")
 	c.PersistentFlags().StringVarP(&c.ProjectID, "project", "p", "", "google project id to use")
+	c.PersistentFlags().StringVarP(&c.LogFormat, "log-format", "", "text", "of the log entries, either text or json")
+}
+
+// SetupLogging configures the logging with the --log-format and --debug flags of the command
+func SetupLogging(command *cobra.Command, _ []string) error {
+	format, _ := command.Flags().GetString("log-format")
+	debug, _ := command.Flags().GetBool("debug")
+	return logging.Setup(format, debug)
+}
+
+// AddCertificatePersistentFlags adds the persistent flags for the key and certificate to serve https
+func (c *RootCommand) AddCertificatePersistentFlags() {
 	c.PersistentFlags().StringVarP(&c.KeyFile, "key-file", "k", "", "key file for serving https")
 	c.PersistentFlags().StringVarP(&c.CertificateFile, "certificate-file", "c", "", "certificate of the server")
-	c.MarkPersistentFlagRequired("key-file")
 	c.MarkPersistentFlagFilename("key-file")
-	c.MarkPersistentFlagRequired("certificate-file")
 	c.MarkPersistentFlagFilename("certificate-file")
+	c.AddKeyPassphraseFlags(c.PersistentFlags())
+	c.PersistentFlags().BoolVarP(&c.EphemeralCertificate, "ephemeral-certificate", "", false, "generate the certificate in memory when no key and certificate file are specified, instead of in the user config directory")
+}
+
+// AddMetricsFlags adds the flag for the address to serve the metrics on
+func (c *RootCommand) AddMetricsFlags(flags *pflag.FlagSet) {
+	flags.StringVarP(&c.MetricsAddress, "metrics-address", "", "", "address to serve prometheus metrics on, for example :9090")
+}
+
+// AddTracingFlags adds the flags for the export of the traces
+func (c *RootCommand) AddTracingFlags(flags *pflag.FlagSet) {
+	flags.StringVarP(&c.Tracing.Exporter, "trace-exporter", "", "", "to export traces with, either otlp, stdout or file")
+	flags.StringVarP(&c.Tracing.File, "trace-file", "", "", "to write the traces to with the file exporter")
+	flags.Float64VarP(&c.Tracing.SampleRatio, "trace-sample-ratio", "", 1.0, "of the traces to sample, when not sampled by the caller")
+}
+
+// AddKeyPassphraseFlags adds the flags for the passphrase of an encrypted private key
+func (c *RootCommand) AddKeyPassphraseFlags(flags *pflag.FlagSet) {
+	flags.StringVarP(&c.KeyPassphraseEnv, "key-passphrase-env", "", "", "environment variable containing the passphrase of the private key")
+	flags.StringVarP(&c.KeyPassphraseFile, "key-passphrase-file", "", "", "file containing the passphrase of the private key")
 }
 
 func getPort() int {
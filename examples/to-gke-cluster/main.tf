@@ -52,7 +52,7 @@ resource "google_compute_region_instance_group_manager" "iap_proxy" {
   }
 
   auto_healing_policies {
-    health_check      = google_compute_health_check.iap_proxy_https.id
+    health_check      = google_compute_health_check.iap_proxy_https_live.id
     initial_delay_sec = 300
   }
 
@@ -73,7 +73,28 @@ resource "google_compute_health_check" "iap_proxy_https" {
 
   https_health_check {
     port         = "8443"
-    request_path = "/__health"
+    request_path = "/__ready"
+  }
+
+  log_config {
+    enable = true
+  }
+
+  lifecycle {
+    create_before_destroy = true
+  }
+}
+
+resource "google_compute_health_check" "iap_proxy_https_live" {
+  name                = "iap-proxy-https-live"
+  check_interval_sec  = 10
+  timeout_sec         = 5
+  healthy_threshold   = 2
+  unhealthy_threshold = 10 # 100 seconds
+
+  https_health_check {
+    port         = "8443"
+    request_path = "/__live"
   }
 
   log_config {
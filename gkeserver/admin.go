@@ -0,0 +1,32 @@
+package gkeserver
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+)
+
+// listenAndServeAdmin serves the admin endpoints on the address until the context is done. The admin endpoints
+// are not served on the port exposed via IAP, as they are not meant for the users of the proxy. Does nothing if
+// no address is specified.
+func (p *ReverseProxy) listenAndServeAdmin(ctx context.Context, address string) {
+	if address == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/__refresh", refreshHandler(p.clusterInfo))
+	srv := &http.Server{Addr: address, Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	go func() {
+		slog.Info("serving admin endpoints", "address", address)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("failed to serve admin endpoints", "address", address, "error", err)
+		}
+	}()
+}
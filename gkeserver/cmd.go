@@ -1,6 +1,8 @@
 package gkeserver
 
 import (
+	"time"
+
 	"github.com/binxio/simple-iap-proxy/cmd"
 	"github.com/spf13/cobra"
 )
@@ -20,6 +22,20 @@ forwards the request to it. Reject requests for any other endpoint.
 		},
 	}
 	c.AddPersistentFlags()
+	c.MarkPersistentFlagRequired("key-file")
+	c.MarkPersistentFlagRequired("certificate-file")
+	c.PersistentFlags().MarkHidden("ephemeral-certificate")
+	c.AddMetricsFlags(c.Flags())
+	c.AddTracingFlags(c.Flags())
+	c.Flags().DurationVarP(&c.ReadyMaxCacheAge, "ready-max-cache-age", "", 15*time.Minute, "age of the cluster information after which /__ready fails")
+	c.Flags().DurationVarP(&c.ProbeInterval, "probe-interval", "", 30*time.Second, "interval at which the cluster masters are probed, 0 to disable probing")
+	c.Flags().DurationVarP(&c.ProbeTimeout, "probe-timeout", "", 5*time.Second, "timeout of a probe of a cluster master")
+	c.Flags().StringVarP(&c.AdminAddress, "admin-address", "", "", "address to serve the admin endpoints on, for example 127.0.0.1:9091")
+	c.Flags().StringVarP(&c.Audit.File, "audit-log", "", "", "file to write the audit log to, - for stdout")
+	c.Flags().IntVarP(&c.Audit.MaxSize, "audit-log-max-size", "", 100, "size in megabytes at which the audit log is rotated")
+	c.Flags().IntVarP(&c.Audit.MaxBackups, "audit-log-max-backups", "", 10, "number of rotated audit logs to keep")
+	c.Flags().IntVarP(&c.Audit.MaxAge, "audit-log-max-age", "", 0, "days to keep the rotated audit logs, 0 to keep them regardless of age")
+	c.Flags().StringVarP(&c.Audit.IAPAudience, "iap-audience", "", "", "audience of the IAP JWT assertion, /projects/<number>/global/backendServices/<id>, to verify the users in the audit log")
 	c.RunE = func(cmd *cobra.Command, args []string) error {
 		return c.Run()
 	}
@@ -0,0 +1,106 @@
+package gkeserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// cacheState provides the state of the cluster information cache
+type cacheState interface {
+	Size() int
+	LastRefresh() time.Time
+	LastError() error
+}
+
+// readiness is the body of the readiness response
+type readiness struct {
+	Status          string    `json:"status"`
+	Reason          string    `json:"reason,omitempty"`
+	Clusters        int       `json:"clusters"`
+	LastRefresh     time.Time `json:"lastRefresh"`
+	CacheAgeSeconds float64   `json:"cacheAgeSeconds"`
+	LastError       string    `json:"lastError,omitempty"`
+}
+
+// liveHandler reports that the process is serving requests
+func liveHandler(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyHandler returns the handler which reports whether requests can be forwarded to the clusters. The
+// service is not ready when the cache is empty, or when the last successful refresh is older than maxAge.
+func readyHandler(cache cacheState, maxAge time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		state := readiness{
+			Status:      "ok",
+			Clusters:    cache.Size(),
+			LastRefresh: cache.LastRefresh().UTC(),
+		}
+		age := time.Since(state.LastRefresh)
+		state.CacheAgeSeconds = age.Seconds()
+		if err := cache.LastError(); err != nil {
+			state.LastError = err.Error()
+		}
+
+		switch {
+		case state.Clusters == 0:
+			state.Reason = "no running clusters found"
+		case age > maxAge:
+			state.Reason = fmt.Sprintf("cluster information not refreshed for %s", age.Round(time.Second))
+		}
+		if state.Reason != "" {
+			state.Status = "unavailable"
+			writeJSON(w, http.StatusServiceUnavailable, state)
+			return
+		}
+		writeJSON(w, http.StatusOK, state)
+	}
+}
+
+// refresher refreshes the cluster information on request
+type refresher interface {
+	cacheState
+	RequestRefresh(ctx context.Context) (bool, error)
+}
+
+// refreshHandler returns the handler which refreshes the cluster information on a POST, unless it was refreshed
+// very recently, and returns the state of the cache
+func refreshHandler(cache refresher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"status": "method not allowed"})
+			return
+		}
+
+		refreshed, err := cache.RequestRefresh(r.Context())
+		state := readiness{
+			Status:      "refreshed",
+			Clusters:    cache.Size(),
+			LastRefresh: cache.LastRefresh().UTC(),
+		}
+		state.CacheAgeSeconds = time.Since(state.LastRefresh).Seconds()
+		switch {
+		case err != nil:
+			state.Status = "failed"
+			state.LastError = err.Error()
+			writeJSON(w, http.StatusBadGateway, state)
+		case !refreshed:
+			state.Status = "skipped"
+			state.Reason = "refreshed very recently, try again later"
+			writeJSON(w, http.StatusTooManyRequests, state)
+		default:
+			writeJSON(w, http.StatusOK, state)
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(body)
+}
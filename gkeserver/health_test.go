@@ -0,0 +1,52 @@
+package gkeserver
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type fakeCache struct {
+	size        int
+	lastRefresh time.Time
+	lastError   error
+}
+
+func (f *fakeCache) Size() int              { return f.size }
+func (f *fakeCache) LastRefresh() time.Time { return f.lastRefresh }
+func (f *fakeCache) LastError() error       { return f.lastError }
+
+func TestReadyHandler(t *testing.T) {
+	tests := []struct {
+		name  string
+		cache fakeCache
+		code  int
+	}{
+		{"fresh", fakeCache{size: 2, lastRefresh: time.Now()}, http.StatusOK},
+		{"empty", fakeCache{size: 0, lastRefresh: time.Now()}, http.StatusServiceUnavailable},
+		{"stale", fakeCache{size: 2, lastRefresh: time.Now().Add(-time.Hour), lastError: errors.New("permission denied")},
+			http.StatusServiceUnavailable},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		readyHandler(&test.cache, 15*time.Minute)(w, httptest.NewRequest(http.MethodGet, "/__ready", nil))
+		if w.Code != test.code {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.code, w.Code)
+		}
+
+		var body readiness
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s: expected a JSON body, got %s", test.name, w.Body.String())
+		}
+		if body.Clusters != test.cache.size || (test.code != http.StatusOK && body.Reason == "") {
+			t.Errorf("%s: expected the cluster count and reason, got %s", test.name, w.Body.String())
+		}
+		if test.cache.lastError != nil && body.LastError != test.cache.lastError.Error() {
+			t.Errorf("%s: expected the last error, got %s", test.name, w.Body.String())
+		}
+	}
+}
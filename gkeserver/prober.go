@@ -0,0 +1,206 @@
+package gkeserver
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/binxio/simple-iap-proxy/clusterinfo"
+	"github.com/binxio/simple-iap-proxy/metrics"
+)
+
+// ProbeResult is the result of the last probe of a cluster master
+type ProbeResult struct {
+	Cluster        string    `json:"cluster"`
+	Endpoint       string    `json:"endpoint"`
+	Up             bool      `json:"up"`
+	Path           string    `json:"path,omitempty"`
+	StatusCode     int       `json:"statusCode,omitempty"`
+	Error          string    `json:"error,omitempty"`
+	LatencySeconds float64   `json:"latencySeconds"`
+	Time           time.Time `json:"time"`
+}
+
+// clusterSource provides the clusters to probe
+type clusterSource interface {
+	GetMap() *clusterinfo.Map
+}
+
+// Prober periodically probes the masters of the clusters in the cache
+type Prober struct {
+	clusters clusterSource
+	interval time.Duration
+	timeout  time.Duration
+	mutex    sync.RWMutex
+	results  map[string]*ProbeResult
+}
+
+// NewProber returns a prober of the masters of the clusters, which probes each master every interval
+func NewProber(clusters clusterSource, interval, timeout time.Duration) *Prober {
+	return &Prober{
+		clusters: clusters,
+		interval: interval,
+		timeout:  timeout,
+		results:  make(map[string]*ProbeResult),
+	}
+}
+
+// Run probes the masters until the context is done
+func (p *Prober) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		p.ProbeAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ProbeAll probes the masters of all clusters in parallel, and forgets the clusters which are no longer in the cache
+func (p *Prober) ProbeAll(ctx context.Context) {
+	clusters := p.clusters.GetMap()
+
+	var wg sync.WaitGroup
+	for endpoint, info := range *clusters {
+		wg.Add(1)
+		go func(endpoint string, info *clusterinfo.ConnectInfo) {
+			defer wg.Done()
+			if result := p.probeWithRefresh(ctx, info); ctx.Err() == nil {
+				p.store(endpoint, result)
+			}
+		}(endpoint, info)
+	}
+	wg.Wait()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for endpoint, result := range p.results {
+		if _, ok := (*clusters)[endpoint]; !ok {
+			delete(p.results, endpoint)
+			metrics.ClusterUp.DeleteLabelValues(result.Cluster)
+			metrics.ClusterProbeDuration.DeleteLabelValues(result.Cluster)
+		}
+	}
+}
+
+// probeWithRefresh probes the master of the cluster, and probes it again after refreshing the CA of the cluster
+// if the certificate of the master cannot be verified, like the upstream transport does for requests
+func (p *Prober) probeWithRefresh(ctx context.Context, info *clusterinfo.ConnectInfo) *ProbeResult {
+	result, err := p.probe(ctx, info)
+	refresher, ok := p.clusters.(clusterRefresher)
+	if err == nil || !ok || !isCertificateVerificationError(err) {
+		return result
+	}
+	refreshed, refreshErr := refresher.RefreshCluster(ctx, info.Endpoint)
+	if refreshErr != nil || refreshed.ClusterCaCertificate == info.ClusterCaCertificate {
+		return result
+	}
+	result, _ = p.probe(ctx, refreshed)
+	return result
+}
+
+// probe checks the master of the cluster with a TLS handshake against the CA of the cluster and a request for
+// /readyz, or /livez if the master does not support it. The master is up when it answers the request with a
+// status other than a server error: if anonymous access is disabled, the master still proves it is reachable
+// by answering 401 or 403.
+func (p *Prober) probe(ctx context.Context, info *clusterinfo.ConnectInfo) (*ProbeResult, error) {
+	result := &ProbeResult{Cluster: info.Name, Endpoint: info.Endpoint, Time: time.Now().UTC()}
+	client := &http.Client{
+		Timeout: p.timeout,
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: info.RootCAs},
+			DisableKeepAlives: true,
+		},
+	}
+
+	var err error
+	start := time.Now()
+	for _, path := range []string{"/readyz", "/livez"} {
+		result.Path = path
+		var request *http.Request
+		if request, err = http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("https://%s%s", info.Endpoint, path), nil); err != nil {
+			result.Error = err.Error()
+			break
+		}
+		var response *http.Response
+		if response, err = client.Do(request); err != nil {
+			result.Error = err.Error()
+			break
+		}
+		_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, 4096))
+		response.Body.Close()
+
+		result.StatusCode = response.StatusCode
+		if response.StatusCode == http.StatusNotFound {
+			continue
+		}
+		if response.StatusCode >= http.StatusInternalServerError {
+			result.Error = fmt.Sprintf("%s returned status %d", path, response.StatusCode)
+		}
+		break
+	}
+	result.LatencySeconds = time.Since(start).Seconds()
+	result.Up = result.Error == ""
+	return result, err
+}
+
+func (p *Prober) store(endpoint string, result *ProbeResult) {
+	p.mutex.Lock()
+	previous := p.results[endpoint]
+	p.results[endpoint] = result
+	p.mutex.Unlock()
+
+	if result.Up {
+		metrics.ClusterUp.WithLabelValues(result.Cluster).Set(1)
+	} else {
+		metrics.ClusterUp.WithLabelValues(result.Cluster).Set(0)
+	}
+	metrics.ClusterProbeDuration.WithLabelValues(result.Cluster).Set(result.LatencySeconds)
+
+	switch {
+	case !result.Up && (previous == nil || previous.Up):
+		slog.Warn("cluster master is down", "cluster", result.Cluster, "endpoint", endpoint, "error", result.Error)
+	case result.Up && previous != nil && !previous.Up:
+		slog.Info("cluster master is up again", "cluster", result.Cluster, "endpoint", endpoint)
+	}
+}
+
+// Down returns the result of the last probe of the master of the cluster at the endpoint, if it is down. Returns
+// nil if the master is up, or has not been probed yet.
+func (p *Prober) Down(endpoint string) *ProbeResult {
+	if p == nil {
+		return nil
+	}
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	if result, ok := p.results[endpoint]; ok && !result.Up {
+		return result
+	}
+	return nil
+}
+
+// Results returns the results of the last probes, ordered by cluster name
+func (p *Prober) Results() []ProbeResult {
+	if p == nil {
+		return []ProbeResult{}
+	}
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	result := make([]ProbeResult, 0, len(p.results))
+	for _, r := range p.results {
+		result = append(result, *r)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Cluster < result[j].Cluster
+	})
+	return result
+}
@@ -0,0 +1,76 @@
+package gkeserver
+
+import (
+	"context"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/binxio/simple-iap-proxy/clusterinfo"
+)
+
+type fakeClusters struct {
+	clusters clusterinfo.Map
+}
+
+func (f *fakeClusters) GetMap() *clusterinfo.Map { return &f.clusters }
+
+func newMaster(t *testing.T, handler http.HandlerFunc) *clusterinfo.ConnectInfo {
+	server := httptest.NewTLSServer(handler)
+	t.Cleanup(server.Close)
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(server.Certificate())
+	endpoint := strings.TrimPrefix(server.URL, "https://")
+	return &clusterinfo.ConnectInfo{Name: endpoint, Endpoint: endpoint, RootCAs: rootCAs}
+}
+
+func TestProber(t *testing.T) {
+	ready := newMaster(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	live := newMaster(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/readyz" {
+			http.NotFound(w, r)
+		}
+	})
+	failing := newMaster(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	untrusted := newMaster(t, func(w http.ResponseWriter, r *http.Request) {})
+	untrusted.RootCAs = x509.NewCertPool()
+
+	clusters := &fakeClusters{clusters: clusterinfo.Map{}}
+	for _, info := range []*clusterinfo.ConnectInfo{ready, live, failing, untrusted} {
+		clusters.clusters[info.Endpoint] = info
+	}
+	prober := NewProber(clusters, time.Minute, 5*time.Second)
+	prober.ProbeAll(context.Background())
+
+	if prober.Down(ready.Endpoint) != nil {
+		t.Errorf("expected the ready master to be up")
+	}
+	if prober.Down(live.Endpoint) != nil {
+		t.Errorf("expected the master without /readyz to be up")
+	}
+	if result := prober.Down(failing.Endpoint); result == nil || result.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected the failing master to be down, got %+v", result)
+	}
+	if result := prober.Down(untrusted.Endpoint); result == nil || !strings.Contains(result.Error, "certificate") {
+		t.Errorf("expected the master with an untrusted certificate to be down, got %+v", result)
+	}
+
+	delete(clusters.clusters, failing.Endpoint)
+	prober.ProbeAll(context.Background())
+	if results := prober.Results(); len(results) != 3 || prober.Down(failing.Endpoint) != nil {
+		t.Errorf("expected the removed cluster to be forgotten, got %+v", results)
+	}
+
+	w := httptest.NewRecorder()
+	statusHandler(prober)(w, httptest.NewRequest(http.MethodGet, "/__status", nil))
+	if !strings.Contains(w.Body.String(), untrusted.Endpoint) || !strings.Contains(w.Body.String(), "down") {
+		t.Errorf("expected the status page to list the clusters, got %s", w.Body.String())
+	}
+}
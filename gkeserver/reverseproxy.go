@@ -7,18 +7,39 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"syscall"
 	"time"
 
 	"github.com/binxio/simple-iap-proxy/cmd"
 
+	"github.com/binxio/simple-iap-proxy/audit"
 	"github.com/binxio/simple-iap-proxy/clusterinfo"
+	"github.com/binxio/simple-iap-proxy/metrics"
+	"github.com/binxio/simple-iap-proxy/requestid"
+	"github.com/binxio/simple-iap-proxy/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/oauth2/google"
 )
 
+// the steps of the gke-server reported in the error responses
+const (
+	stepClusterLookup = "cluster-lookup"
+	stepClusterHealth = "cluster-health"
+	stepUpstream      = "upstream"
+)
+
 // ReverseProxy provides the runtime configuration of the Reverse Proxy
 type ReverseProxy struct {
 	cmd.RootCommand
-	clusterInfo *clusterinfo.Cache
+	Audit            audit.Options
+	ReadyMaxCacheAge time.Duration
+	ProbeInterval    time.Duration
+	ProbeTimeout     time.Duration
+	AdminAddress     string
+	clusterInfo      *clusterinfo.Cache
+	auditLog         *audit.Logger
+	prober           *Prober
 }
 
 func (p *ReverseProxy) retrieveClusterInfo(ctx context.Context) error {
@@ -38,33 +59,47 @@ func (p *ReverseProxy) retrieveClusterInfo(ctx context.Context) error {
 	return err
 }
 
-func healthCheckHandler(w http.ResponseWriter, _ *http.Request) {
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	fmt.Fprintf(w, "service is healthy\n")
-}
+func (p *ReverseProxy) ServeHTTP(writer http.ResponseWriter, r *http.Request) {
+	id := requestid.Ensure(r)
+	w := newStatusRecorder(writer, r, id, p.auditLog)
+	w.Header().Set(requestid.Header, id)
+	r, w.span = tracing.StartSpan(r, "gke-server "+r.Method, trace.SpanKindServer, attribute.String("request.id", id))
+	defer w.observe()
 
-func (p *ReverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	clusterInfo := p.clusterInfo.GetConnectInfoForEndpoint(r.Host)
+	_, lookupSpan := tracing.StartChildSpan(r, stepClusterLookup, trace.SpanKindInternal)
+	clusterInfo := p.clusterInfo.LookupConnectInfo(r.Context(), r.Host)
+	lookupSpan.End()
 	if clusterInfo == nil {
-		w.WriteHeader(http.StatusBadGateway)
-		w.Write([]byte(fmt.Sprintf("%s is not a cluster endpoint", r.Host)))
+		w.writeError(r, http.StatusBadGateway, stepClusterLookup,
+			fmt.Sprintf("%s is not a cluster endpoint", r.Host))
+		return
+	}
+	w.target = clusterInfo.Name
+	w.span.SetAttributes(attribute.String("gke.cluster", clusterInfo.Name))
+
+	if down := p.prober.Down(clusterInfo.Endpoint); down != nil {
+		w.writeError(r, http.StatusServiceUnavailable, stepClusterHealth,
+			fmt.Sprintf("the master of cluster %s is down since the probe at %s, %s",
+				clusterInfo.Name, down.Time.Format(time.RFC3339), down.Error))
 		return
 	}
 
 	targetURL, err := url.Parse(fmt.Sprintf("https://%s", r.Host))
-	if clusterInfo == nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf("failed to parse URL https://%s, %s", r.Host, err)))
+	if err != nil {
+		w.writeError(r, http.StatusInternalServerError, stepClusterLookup,
+			fmt.Sprintf("failed to parse URL https://%s, %s", r.Host, err))
 		return
 	}
 	proxy := httputil.NewSingleHostReverseProxy(targetURL)
-	proxy.Transport = &http.Transport{
-		TLSClientConfig: &tls.Config{
-			RootCAs: clusterInfo.RootCAs,
-		},
+	proxy.Transport = &upstreamTransport{clusters: p.clusterInfo, info: clusterInfo}
+	proxy.ErrorHandler = func(_ http.ResponseWriter, r *http.Request, err error) {
+		w.writeError(r, http.StatusBadGateway, stepUpstream,
+			fmt.Sprintf("failed to forward the request to cluster %s, %s", clusterInfo.Name, err))
 	}
 
-	proxy.ServeHTTP(w, r)
+	r, upstreamSpan := tracing.StartChildSpan(r, stepUpstream, trace.SpanKindClient)
+	defer upstreamSpan.End()
+	proxy.ServeHTTP(w, tracing.WithClientTrace(r))
 }
 
 // Run the reverse proxy until stopped
@@ -74,18 +109,47 @@ func (p *ReverseProxy) Run() error {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	shutdown, err := tracing.Start(ctx, "simple-iap-proxy-gke-server", p.Tracing)
+	if err != nil {
+		return err
+	}
+	defer shutdown()
+
+	if p.auditLog, err = audit.New(p.Audit); err != nil {
+		return fmt.Errorf("failed to open the audit log, %s", err)
+	}
+	defer p.auditLog.Close()
+
+	certificate, err := p.NewReloadingCertificate(ctx)
+	if err != nil {
+		return err
+	}
+
 	if err = p.retrieveClusterInfo(ctx); err != nil {
 		return fmt.Errorf("failed to retrieve cluster information, %s", err)
 	}
+	metrics.RegisterClusterCache(p.clusterInfo)
+	go p.clusterInfo.RefreshOnSignal(ctx, syscall.SIGHUP)
+	metrics.ListenAndServe(ctx, p.MetricsAddress)
+	p.listenAndServeAdmin(ctx, p.AdminAddress)
+
+	if p.ProbeInterval > 0 {
+		p.prober = NewProber(p.clusterInfo, p.ProbeInterval, p.ProbeTimeout)
+		go p.prober.Run(ctx)
+	}
 
 	http.Handle("/", p)
-	http.HandleFunc("/__health", healthCheckHandler)
+	http.HandleFunc("/__live", liveHandler)
+	http.Handle("/__ready", readyHandler(p.clusterInfo, p.ReadyMaxCacheAge))
+	http.HandleFunc("/__health", liveHandler)
+	http.Handle("/__status", statusHandler(p.prober))
 
 	srv := &http.Server{
 		Addr:         fmt.Sprintf(":%d", p.Port),
 		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+		TLSConfig:    &tls.Config{GetCertificate: certificate.GetCertificate},
 	}
 
-	err = srv.ListenAndServeTLS(p.CertificateFile, p.KeyFile)
+	err = srv.ListenAndServeTLS("", "")
 	return err
 }
@@ -0,0 +1,61 @@
+package gkeserver
+
+import (
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+var statusPage = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>simple-iap-proxy gke-server status</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+.up { color: #188038; }
+.down { color: #d93025; }
+</style>
+</head>
+<body>
+<h1>Cluster masters</h1>
+<table>
+<tr><th>cluster</th><th>endpoint</th><th>status</th><th>probe</th><th>latency</th><th>probed at</th><th>error</th></tr>
+{{- range . }}
+<tr>
+<td>{{ .Cluster }}</td>
+<td>{{ .Endpoint }}</td>
+<td>{{ if .Up }}<span class="up">up</span>{{ else }}<span class="down">down</span>{{ end }}</td>
+<td>{{ .Path }}{{ if .StatusCode }} {{ .StatusCode }}{{ end }}</td>
+<td>{{ printf "%.3fs" .LatencySeconds }}</td>
+<td>{{ .Time.Format "2006-01-02T15:04:05Z07:00" }}</td>
+<td>{{ .Error }}</td>
+</tr>
+{{- else }}
+<tr><td colspan="7">no clusters probed yet</td></tr>
+{{- end }}
+</table>
+</body>
+</html>
+`))
+
+// statusHandler returns the handler of the status page of the cluster masters, in HTML or in JSON when
+// requested by the Accept header or the format=json query parameter
+func statusHandler(prober *Prober) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		results := prober.Results()
+		if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+			writeJSON(w, http.StatusOK, map[string]any{"clusters": results})
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := statusPage.Execute(w, results); err != nil {
+			slog.Error("failed to write the status page", "error", err)
+		}
+	}
+}
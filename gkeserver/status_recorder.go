@@ -0,0 +1,60 @@
+package gkeserver
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/binxio/simple-iap-proxy/audit"
+	"github.com/binxio/simple-iap-proxy/logging"
+	"github.com/binxio/simple-iap-proxy/metrics"
+	"github.com/binxio/simple-iap-proxy/proxyerror"
+	"github.com/binxio/simple-iap-proxy/tracing"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// statusRecorder records the status code of the response and the step in which the request failed, to
+// report the request in the metrics, trace, log and audit log
+type statusRecorder struct {
+	http.ResponseWriter
+	request *http.Request
+	id      string
+	start   time.Time
+	target  string
+	code    int
+	step    string
+	span    trace.Span
+	audit   *audit.Logger
+}
+
+func newStatusRecorder(w http.ResponseWriter, r *http.Request, id string, auditLog *audit.Logger) *statusRecorder {
+	return &statusRecorder{ResponseWriter: w, request: r, id: id, start: time.Now(), target: "unknown", code: http.StatusOK, audit: auditLog}
+}
+
+// WriteHeader records the status code
+func (s *statusRecorder) WriteHeader(code int) {
+	s.code = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap returns the original response writer, so that flushing and hijacking keep working
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// writeError writes the error response, and records the step which failed
+func (s *statusRecorder) writeError(r *http.Request, code int, step, message string) {
+	s.step = step
+	proxyerror.Write(s, r, code, step, message)
+}
+
+// observe records the request in the metrics, log and audit log, and ends the span of the request
+func (s *statusRecorder) observe() {
+	metrics.ObserveRequest(s.target, s.code, s.step, s.start)
+	tracing.EndSpan(s.span, s.code, s.step)
+	slog.Info("forwarded request", "requestId", s.id, "target", s.target, "step", s.step,
+		logging.HTTPRequest(s.request, s.code, time.Since(s.start)))
+	if err := s.audit.Log(s.request, s.id, s.target, s.code, s.start); err != nil {
+		slog.Error("failed to write the audit log", "requestId", s.id, "error", err)
+	}
+}
@@ -0,0 +1,87 @@
+package gkeserver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/binxio/simple-iap-proxy/clusterinfo"
+)
+
+// clusterRefresher refreshes the connect information of a single cluster
+type clusterRefresher interface {
+	RefreshCluster(ctx context.Context, endpoint string) (*clusterinfo.ConnectInfo, error)
+}
+
+// upstreamTransport forwards the request to the master of the cluster. When the certificate of the master cannot
+// be verified, the CA of the cluster may have been rotated: the connect information of the cluster is refreshed,
+// and the request is retried once with the new CA.
+type upstreamTransport struct {
+	clusters clusterRefresher
+	info     *clusterinfo.ConnectInfo
+}
+
+func newTransport(info *clusterinfo.ConnectInfo) http.RoundTripper {
+	return &http.Transport{
+		TLSClientConfig: &tls.Config{
+			RootCAs: info.RootCAs,
+		},
+	}
+}
+
+// RoundTrip forwards the request, and retries it with the refreshed CA of the cluster on a certificate verification
+// failure. The request is only retried if its body has not been read yet.
+func (t *upstreamTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	var body *unreadBody
+	if r.Body != nil && r.Body != http.NoBody {
+		body = &unreadBody{ReadCloser: r.Body}
+		r.Body = body
+	}
+
+	response, err := newTransport(t.info).RoundTrip(r)
+	if err == nil || !isCertificateVerificationError(err) || (body != nil && body.read) {
+		return response, err
+	}
+
+	slog.Warn("failed to verify the certificate of the cluster master, refreshing the cluster CA",
+		"cluster", t.info.Name, "endpoint", t.info.Endpoint, "error", err)
+	info, refreshErr := t.clusters.RefreshCluster(r.Context(), t.info.Endpoint)
+	if refreshErr != nil {
+		slog.Error("failed to refresh the cluster CA", "cluster", t.info.Name, "error", refreshErr)
+		return nil, err
+	}
+	if info.ClusterCaCertificate == t.info.ClusterCaCertificate {
+		return nil, err
+	}
+
+	slog.Info("retrying the request with the refreshed cluster CA", "cluster", info.Name)
+	t.info = info
+	return newTransport(info).RoundTrip(r)
+}
+
+// isCertificateVerificationError returns true if the error is caused by a certificate which is not trusted
+func isCertificateVerificationError(err error) bool {
+	var verificationError *tls.CertificateVerificationError
+	var unknownAuthorityError x509.UnknownAuthorityError
+	return errors.As(err, &verificationError) || errors.As(err, &unknownAuthorityError)
+}
+
+// unreadBody records whether the body of the request was read, so that the request can be retried if it was not.
+// Closing is left to the server, which closes the request body after the handler returns.
+type unreadBody struct {
+	io.ReadCloser
+	read bool
+}
+
+func (b *unreadBody) Read(p []byte) (int, error) {
+	b.read = true
+	return b.ReadCloser.Read(p)
+}
+
+func (b *unreadBody) Close() error {
+	return nil
+}
@@ -0,0 +1,54 @@
+package gkeserver
+
+import (
+	"context"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/binxio/simple-iap-proxy/clusterinfo"
+)
+
+type fakeRefresher struct {
+	info      *clusterinfo.ConnectInfo
+	refreshes int
+}
+
+func (f *fakeRefresher) RefreshCluster(_ context.Context, _ string) (*clusterinfo.ConnectInfo, error) {
+	f.refreshes++
+	return f.info, nil
+}
+
+func TestUpstreamTransportRefreshesCA(t *testing.T) {
+	master := newMaster(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write(body)
+	})
+	master.ClusterCaCertificate = "rotated"
+	stale := &clusterinfo.ConnectInfo{Name: master.Name, Endpoint: master.Endpoint, ClusterCaCertificate: "stale",
+		RootCAs: x509.NewCertPool()}
+
+	refresher := &fakeRefresher{info: master}
+	transport := &upstreamTransport{clusters: refresher, info: stale}
+	request := httptest.NewRequest(http.MethodPost, "https://"+master.Endpoint+"/api/v1/namespaces", strings.NewReader("{}"))
+	request.RequestURI = ""
+
+	response, err := transport.RoundTrip(request)
+	if err != nil {
+		t.Fatalf("expected the request to be retried with the refreshed CA, got %s", err)
+	}
+	defer response.Body.Close()
+	if body, _ := io.ReadAll(response.Body); string(body) != "{}" || refresher.refreshes != 1 {
+		t.Errorf("expected the body to be forwarded after a single refresh, got %q after %d refreshes", body, refresher.refreshes)
+	}
+
+	// the CA did not change, so the request is not retried
+	refresher.info = stale
+	transport = &upstreamTransport{clusters: refresher, info: stale}
+	if _, err = transport.RoundTrip(request); err == nil || !isCertificateVerificationError(err) {
+		t.Errorf("expected a certificate verification error, got %v", err)
+	}
+}
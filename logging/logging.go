@@ -0,0 +1,115 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Setup configures the default logger to write leveled, structured log entries in the format, either text
+// or json. The json format uses the field names recognised by Google Cloud Logging.
+func Setup(format string, debug bool) error {
+	handler, err := NewHandler(os.Stderr, format, debug)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// NewHandler returns the log handler writing to w in the format
+func NewHandler(w io.Writer, format string, debug bool) (slog.Handler, error) {
+	options := &slog.HandlerOptions{Level: slog.LevelInfo}
+	if debug {
+		options.Level = slog.LevelDebug
+	}
+
+	switch format {
+	case "", "text":
+		return slog.NewTextHandler(w, options), nil
+	case "json":
+		options.ReplaceAttr = cloudLoggingAttr
+		return slog.NewJSONHandler(w, options), nil
+	default:
+		return nil, fmt.Errorf("unsupported log format %s, expected text or json", format)
+	}
+}
+
+// cloudLoggingAttr renames the level and message to the severity and message fields of Cloud Logging
+func cloudLoggingAttr(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) > 0 {
+		return a
+	}
+	switch a.Key {
+	case slog.LevelKey:
+		a.Key = "severity"
+		if level, ok := a.Value.Any().(slog.Level); ok {
+			a.Value = slog.StringValue(severity(level))
+		}
+	case slog.MessageKey:
+		a.Key = "message"
+	}
+	return a
+}
+
+// severity returns the Cloud Logging severity of the level
+func severity(level slog.Level) string {
+	switch {
+	case level < slog.LevelInfo:
+		return "DEBUG"
+	case level < slog.LevelWarn:
+		return "INFO"
+	case level < slog.LevelError:
+		return "WARNING"
+	default:
+		return "ERROR"
+	}
+}
+
+// ProxyLogger writes the log messages of goproxy to a structured logger. The warnings, which goproxy always
+// logs, are written at warn level, and the verbose information at debug level.
+type ProxyLogger struct {
+	logger *slog.Logger
+}
+
+// NewProxyLogger returns a goproxy logger writing to the logger
+func NewProxyLogger(logger *slog.Logger) *ProxyLogger {
+	return &ProxyLogger{logger: logger}
+}
+
+// Printf logs the message of goproxy, which is formatted as "[session] LEVEL: message"
+func (l *ProxyLogger) Printf(format string, v ...interface{}) {
+	message := strings.TrimSpace(fmt.Sprintf(format, v...))
+	level := slog.LevelDebug
+	if _, rest, _ := strings.Cut(message, "] "); strings.HasPrefix(rest, "WARN: ") {
+		level = slog.LevelWarn
+	}
+	l.logger.Log(context.Background(), level, message)
+}
+
+// HTTPRequest returns the attribute describing the request in the shape of the Cloud Logging httpRequest field
+func HTTPRequest(r *http.Request, status int, latency time.Duration) slog.Attr {
+	return slog.Group("httpRequest",
+		slog.String("requestMethod", r.Method),
+		slog.String("requestUrl", r.URL.String()),
+		slog.Int("status", status),
+		slog.String("latency", fmt.Sprintf("%.9fs", latency.Seconds())),
+		slog.String("remoteIp", remoteIP(r)),
+		slog.String("userAgent", r.UserAgent()),
+		slog.String("protocol", r.Proto),
+	)
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,69 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCloudLoggingFormat(t *testing.T) {
+	var output bytes.Buffer
+	handler, err := NewHandler(&output, "json", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(handler)
+
+	r := httptest.NewRequest(http.MethodGet, "https://10.0.0.2/api/v1/pods", nil)
+	logger.Debug("not logged")
+	logger.Warn("proxied request", "requestId", "abc", HTTPRequest(r, http.StatusBadGateway, 1500*time.Millisecond))
+
+	var entry struct {
+		Severity    string `json:"severity"`
+		Message     string `json:"message"`
+		RequestID   string `json:"requestId"`
+		HTTPRequest struct {
+			RequestMethod string `json:"requestMethod"`
+			RequestURL    string `json:"requestUrl"`
+			Status        int    `json:"status"`
+			Latency       string `json:"latency"`
+			RemoteIP      string `json:"remoteIp"`
+		} `json:"httpRequest"`
+	}
+	if err = json.Unmarshal(output.Bytes(), &entry); err != nil {
+		t.Fatalf("expected a single JSON log entry, got %s", output.String())
+	}
+	if entry.Severity != "WARNING" || entry.Message != "proxied request" || entry.RequestID != "abc" {
+		t.Errorf("expected the severity, message and request id, got %s", output.String())
+	}
+	if entry.HTTPRequest.Status != http.StatusBadGateway || entry.HTTPRequest.Latency != "1.500000000s" ||
+		entry.HTTPRequest.RemoteIP != "192.0.2.1" || entry.HTTPRequest.RequestMethod != http.MethodGet {
+		t.Errorf("expected the httpRequest fields, got %s", output.String())
+	}
+
+	if _, err = NewHandler(&output, "xml", false); err == nil {
+		t.Errorf("expected an error for an unsupported format")
+	}
+}
+
+func TestProxyLogger(t *testing.T) {
+	var output bytes.Buffer
+	handler, err := NewHandler(&output, "text", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := NewProxyLogger(slog.New(handler))
+
+	logger.Printf("[%03d] INFO: Running %d CONNECT handlers\n", 1, 2)
+	if output.Len() != 0 {
+		t.Errorf("expected the verbose information of goproxy at debug level, got %s", output.String())
+	}
+	logger.Printf("[%03d] WARN: Cannot sign host certificate with provided CA: %s\n", 1, "expired")
+	if !bytes.Contains(output.Bytes(), []byte("level=WARN")) || !bytes.Contains(output.Bytes(), []byte("Cannot sign host certificate")) {
+		t.Errorf("expected the warnings of goproxy at warn level, got %s", output.String())
+	}
+}
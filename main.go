@@ -1,7 +1,8 @@
 package main
 
 import (
-	"log"
+	"log/slog"
+	"os"
 
 	"github.com/binxio/simple-iap-proxy/client"
 	"github.com/binxio/simple-iap-proxy/cmd"
@@ -20,16 +21,21 @@ inject the IAP proxy authorization header.
 `,
 		},
 	}
-	c.AddPersistentFlags()
+	c.AddGlobalPersistentFlags()
+	c.PersistentPreRunE = cmd.SetupLogging
 	c.AddCommand(cmd.NewGenerateCertificateCmd())
+	c.AddCommand(cmd.NewCACmd())
 	c.AddCommand(client.NewClientCmd())
 	c.AddCommand(gkeserver.NewGKEServerCmd())
+	c.AddCommand(client.NewTokenCmd())
+	c.AddCommand(client.NewDoctorCmd())
 	return &c
 }
 
 func main() {
 	cmd := newRootCmd()
 	if err := cmd.Execute(); err != nil {
-		log.Fatalf("ERROR: %s", err)
+		slog.Error("command failed", "error", err)
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,144 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "simple_iap_proxy"
+
+// Registry holds the metrics of the proxy, and the go and process metrics
+var Registry = prometheus.NewRegistry()
+
+var factory = promauto.With(Registry)
+
+var (
+	// Requests counts the proxied requests by target, status code and the step in which the request failed, if any
+	Requests = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_total",
+		Help:      "Number of proxied requests by target, status code and failed step.",
+	}, []string{"target", "code", "error"})
+
+	// RequestDuration observes the duration of the proxied requests by target and status code
+	RequestDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "request_duration_seconds",
+		Help:      "Duration of proxied requests by target and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"target", "code"})
+
+	// TokenRefreshes counts the ID token refreshes after IAP rejected the token, by result
+	TokenRefreshes = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "token_refreshes_total",
+		Help:      "Number of ID token refreshes after IAP rejected the token, by result.",
+	}, []string{"result"})
+
+	// TokenExpiry is the expiry time of the current ID token
+	TokenExpiry = factory.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "token_expiry_timestamp_seconds",
+		Help:      "Expiry time of the current ID token in seconds since the epoch.",
+	})
+
+	// ClusterCacheRefreshes counts the refreshes of the cluster information, by result
+	ClusterCacheRefreshes = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cluster_cache_refreshes_total",
+		Help:      "Number of refreshes of the cluster information, by result.",
+	}, []string{"result"})
+
+	// ClusterUp is 1 if the last probe of the cluster master succeeded, and 0 otherwise
+	ClusterUp = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cluster_up",
+		Help:      "Whether the last probe of the cluster master succeeded.",
+	}, []string{"cluster"})
+
+	// ClusterProbeDuration is the duration of the last probe of the cluster master
+	ClusterProbeDuration = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cluster_probe_duration_seconds",
+		Help:      "Duration of the last probe of the cluster master.",
+	}, []string{"cluster"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// ClusterCache provides the state of the cluster information cache
+type ClusterCache interface {
+	Size() int
+	LastRefresh() time.Time
+}
+
+// RegisterClusterCache registers the gauges for the size and the last successful refresh of the cluster information cache
+func RegisterClusterCache(cache ClusterCache) {
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cluster_cache_clusters",
+		Help:      "Number of clusters in the cluster information cache.",
+	}, func() float64 {
+		return float64(cache.Size())
+	})
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cluster_cache_last_refresh_timestamp_seconds",
+		Help:      "Time of the last successful refresh of the cluster information in seconds since the epoch.",
+	}, func() float64 {
+		return float64(cache.LastRefresh().Unix())
+	})
+}
+
+// Result returns the result label for the error
+func Result(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// ObserveRequest records a request to the target which started at start, with the status code and the step
+// in which it failed, if any
+func ObserveRequest(target string, code int, step string, start time.Time) {
+	status := strconv.Itoa(code)
+	Requests.WithLabelValues(target, status, step).Inc()
+	RequestDuration.WithLabelValues(target, status).Observe(time.Since(start).Seconds())
+}
+
+// ListenAndServe serves the metrics on /metrics of the address until the context is done. Does nothing
+// if no address is specified.
+func ListenAndServe(ctx context.Context, address string) {
+	if address == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry}))
+	srv := &http.Server{Addr: address, Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	go func() {
+		slog.Info("serving metrics", "address", address, "path", "/metrics")
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("failed to serve metrics", "address", address, "error", err)
+		}
+	}()
+}
@@ -0,0 +1,156 @@
+package proxyerror
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/binxio/simple-iap-proxy/requestid"
+)
+
+// StatusCause mirrors the Kubernetes metav1.StatusCause
+type StatusCause struct {
+	Type    string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// StatusDetails mirrors the Kubernetes metav1.StatusDetails
+type StatusDetails struct {
+	Causes []StatusCause `json:"causes,omitempty"`
+}
+
+// Status mirrors the Kubernetes metav1.Status, so that kubectl reports the error of the proxy
+type Status struct {
+	Kind       string         `json:"kind"`
+	APIVersion string         `json:"apiVersion"`
+	Metadata   struct{}       `json:"metadata"`
+	Status     string         `json:"status"`
+	Message    string         `json:"message"`
+	Reason     string         `json:"reason"`
+	Details    *StatusDetails `json:"details,omitempty"`
+	Code       int            `json:"code"`
+}
+
+// Error is the error returned for all other requests
+type Error struct {
+	Error struct {
+		Code      int    `json:"code"`
+		Reason    string `json:"reason"`
+		Step      string `json:"step,omitempty"`
+		Message   string `json:"message"`
+		RequestID string `json:"requestId"`
+	} `json:"error"`
+}
+
+// kubernetesPaths are the path prefixes of the Kubernetes API server
+var kubernetesPaths = []string{"/api", "/apis", "/version", "/openapi", "/healthz", "/livez", "/readyz"}
+
+// IsKubernetesRequest returns true if the request is a call to the Kubernetes API
+func IsKubernetesRequest(r *http.Request) bool {
+	for _, prefix := range kubernetesPaths {
+		if r.URL.Path == prefix || strings.HasPrefix(r.URL.Path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Reason returns the Kubernetes status reason for the HTTP status code
+func Reason(code int) string {
+	switch code {
+	case http.StatusBadRequest:
+		return "BadRequest"
+	case http.StatusUnauthorized:
+		return "Unauthorized"
+	case http.StatusForbidden:
+		return "Forbidden"
+	case http.StatusNotFound:
+		return "NotFound"
+	case http.StatusRequestEntityTooLarge:
+		return "RequestEntityTooLarge"
+	case http.StatusTooManyRequests:
+		return "TooManyRequests"
+	case http.StatusInternalServerError:
+		return "InternalError"
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return "ServiceUnavailable"
+	case http.StatusGatewayTimeout:
+		return "Timeout"
+	default:
+		return "Unknown"
+	}
+}
+
+// Body returns the content type and body of the error response to the request. Kubernetes API calls
+// receive a Status, all other requests an Error. The step names the part of the proxy which failed. The
+// message of the Status includes the request ID, as kubectl only reports the message.
+func Body(r *http.Request, code int, step, message string) (string, []byte) {
+	if IsKubernetesRequest(r) {
+		status := Status{
+			Kind:       "Status",
+			APIVersion: "v1",
+			Status:     "Failure",
+			Message:    message,
+			Reason:     Reason(code),
+			Code:       code,
+		}
+		var causes []StatusCause
+		if step != "" {
+			causes = append(causes, StatusCause{Type: step, Message: message})
+		}
+		if id := requestid.Get(r); id != "" {
+			status.Message = fmt.Sprintf("%s (request ID %s)", message, id)
+			causes = append(causes, StatusCause{Type: "RequestID", Message: id})
+		}
+		if len(causes) > 0 {
+			status.Details = &StatusDetails{Causes: causes}
+		}
+		content, _ := json.Marshal(status)
+		return "application/json", content
+	}
+
+	var body Error
+	body.Error.Code = code
+	body.Error.Reason = Reason(code)
+	body.Error.Step = step
+	body.Error.Message = message
+	body.Error.RequestID = requestid.Get(r)
+	content, _ := json.Marshal(body)
+	return "application/json", content
+}
+
+// Write writes the error response to the request
+func Write(w http.ResponseWriter, r *http.Request, code int, step, message string) {
+	contentType, body := Body(r, code, step, message)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if id := requestid.Get(r); id != "" {
+		w.Header().Set(requestid.Header, id)
+	}
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+// NewResponse returns the error response to the request
+func NewResponse(r *http.Request, code int, step, message string) *http.Response {
+	contentType, body := Body(r, code, step, message)
+	resp := &http.Response{
+		Request:       r,
+		StatusCode:    code,
+		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		ContentLength: int64(len(body)),
+		Body:          io.NopCloser(bytes.NewReader(body)),
+	}
+	resp.Header.Set("Content-Type", contentType)
+	if id := requestid.Get(r); id != "" {
+		resp.Header.Set(requestid.Header, id)
+	}
+	return resp
+}
@@ -0,0 +1,29 @@
+package proxyerror
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/binxio/simple-iap-proxy/requestid"
+)
+
+func TestBodyOfKubernetesRequest(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "https://10.0.0.1/api/v1/namespaces", nil)
+	r.Header.Set(requestid.Header, "0123456789abcdef")
+
+	_, body := Body(r, http.StatusBadGateway, "forward", "failed to forward the request")
+	var status Status
+	if err := json.Unmarshal(body, &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Kind != "Status" || status.Reason != "ServiceUnavailable" || status.Message != "failed to forward the request (request ID 0123456789abcdef)" {
+		t.Errorf("expected a Status with the request ID in the message, got %s", body)
+	}
+	expected := []StatusCause{{"forward", "failed to forward the request"}, {"RequestID", "0123456789abcdef"}}
+	if status.Details == nil || !reflect.DeepEqual(status.Details.Causes, expected) {
+		t.Errorf("expected the causes %v, got %s", expected, body)
+	}
+}
@@ -0,0 +1,34 @@
+package requestid
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// Header is the HTTP header carrying the request ID from the client, via IAP, to the gke-server
+const Header = "X-Request-Id"
+
+// New returns a new random request ID
+func New() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// Get returns the request ID of the request, or an empty string if it has none
+func Get(r *http.Request) string {
+	return r.Header.Get(Header)
+}
+
+// Ensure returns the request ID of the request, after assigning a new one if it has none
+func Ensure(r *http.Request) string {
+	id := Get(r)
+	if id == "" {
+		id = New()
+		r.Header.Set(Header, id)
+	}
+	return id
+}
@@ -0,0 +1,56 @@
+package tracing
+
+import (
+	"net/http"
+	"net/http/httptrace"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/httptrace/otelhttptrace"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// StartSpan starts a span for the request, continuing the trace context in the request headers. Returns
+// the request with the span in its context.
+func StartSpan(r *http.Request, name string, kind trace.SpanKind, attributes ...attribute.KeyValue) (*http.Request, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	attributes = append(attributes,
+		semconv.HTTPMethod(r.Method),
+		attribute.String("http.host", r.Host),
+		attribute.String("http.target", r.URL.Path))
+	ctx, span := Tracer().Start(ctx, name, trace.WithSpanKind(kind), trace.WithAttributes(attributes...))
+	return r.WithContext(ctx), span
+}
+
+// StartChildSpan starts a span for a step in the handling of the request. Returns the request with the span in its context.
+func StartChildSpan(r *http.Request, name string, kind trace.SpanKind) (*http.Request, trace.Span) {
+	ctx, span := Tracer().Start(r.Context(), name, trace.WithSpanKind(kind))
+	return r.WithContext(ctx), span
+}
+
+// Inject sets the W3C trace context of the span in the request context in the request headers
+func Inject(r *http.Request) {
+	otel.GetTextMapPropagator().Inject(r.Context(), propagation.HeaderCarrier(r.Header))
+}
+
+// WithClientTrace returns the request which records the DNS lookup, connect and TLS handshake of its
+// round trip as child spans of the span in the request context
+func WithClientTrace(r *http.Request) *http.Request {
+	ctx := r.Context()
+	return r.WithContext(httptrace.WithClientTrace(ctx, otelhttptrace.NewClientTrace(ctx)))
+}
+
+// EndSpan ends the span with the status code of the response, marking it as failed when a step failed
+func EndSpan(span trace.Span, code int, step string) {
+	span.SetAttributes(semconv.HTTPStatusCode(code))
+	if step != "" {
+		span.SetAttributes(attribute.String("error.step", step))
+		span.SetStatus(codes.Error, step)
+	} else if code >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(code))
+	}
+	span.End()
+}
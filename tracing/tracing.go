@@ -0,0 +1,86 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Options of the trace exporter
+type Options struct {
+	// Exporter is either otlp, stdout, file or empty to disable tracing
+	Exporter string
+	// File to write the spans to with the file exporter
+	File string
+	// SampleRatio of the traces which are not sampled by the caller
+	SampleRatio float64
+}
+
+// Tracer returns the tracer of the proxy
+func Tracer() trace.Tracer {
+	return otel.Tracer("github.com/binxio/simple-iap-proxy")
+}
+
+// Start configures the exporter of the spans of the service, and the W3C trace context propagation. The
+// OTLP exporter is configured with the standard OTEL_EXPORTER_OTLP_* environment variables. Returns the
+// function to flush the remaining spans on shutdown.
+func Start(ctx context.Context, serviceName string, options Options) (func(), error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	var closer io.Closer
+
+	switch options.Exporter {
+	case "":
+		return func() {}, nil
+	case "otlp":
+		exporter, err = otlptracehttp.New(ctx)
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "file":
+		if options.File == "" {
+			return nil, fmt.Errorf("specify a --trace-file for the file exporter")
+		}
+		var file *os.File
+		if file, err = os.OpenFile(options.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644); err != nil {
+			return nil, fmt.Errorf("failed to open %s, %s", options.File, err)
+		}
+		closer = file
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+	default:
+		return nil, fmt.Errorf("unsupported trace exporter %s, expected otlp, stdout or file", options.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s trace exporter, %s", options.Exporter, err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(options.SampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+	slog.Info("exporting traces", "exporter", options.Exporter)
+
+	return func() {
+		if err := provider.Shutdown(context.Background()); err != nil {
+			slog.Warn("failed to flush the traces", "error", err)
+		}
+		if closer != nil {
+			closer.Close()
+		}
+	}, nil
+}
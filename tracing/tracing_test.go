@@ -0,0 +1,47 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestPropagation(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "traces.json")
+	shutdown, err := Start(context.Background(), "test", Options{Exporter: "file", File: file, SampleRatio: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	r := httptest.NewRequest(http.MethodGet, "https://backend.internal/api", nil)
+	r.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+
+	r, span := StartSpan(r, "test", trace.SpanKindClient)
+	if span.SpanContext().TraceID().String() != traceID {
+		t.Fatalf("expected the span to continue trace %s, got %s", traceID, span.SpanContext().TraceID())
+	}
+
+	Inject(r)
+	traceparent := r.Header.Get("traceparent")
+	if !strings.Contains(traceparent, traceID) || strings.Contains(traceparent, "00f067aa0ba902b7") {
+		t.Errorf("expected the trace context of the new span to be propagated, got %s", traceparent)
+	}
+
+	EndSpan(span, http.StatusBadGateway, "upstream")
+	shutdown()
+
+	content, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), traceID) || !strings.Contains(string(content), "upstream") {
+		t.Errorf("expected the span to be written to the file, got %s", content)
+	}
+}